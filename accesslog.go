@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// statusRecorder records the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+type requestInfoKey struct{}
+
+// requestInfo is what the handler learns about a request that the access log logs
+type requestInfo struct {
+	identity string // The authenticated client, "" if none
+}
+
+// setRequestIdentity records the authenticated identity of r's client for the access log
+func setRequestIdentity(r *http.Request, identity string) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.identity = identity
+	}
+}
+
+// accessLog logs every request: the client's address and identity ("-" if none),
+// the method, the URL, the response's status code and the request's duration
+func accessLog(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		// Rejected requests are logged with their client certificate's identity
+		info := &requestInfo{identity: clientIdentity(r)}
+		handler.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		identity := info.identity
+		if identity == "" {
+			identity = "-"
+		}
+		log.Printf("%s %s %s %s %d %v\n", r.RemoteAddr, identity, r.Method, r.URL.RequestURI(), rec.status, time.Since(start))
+	})
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	json "github.com/json-iterator/go"
+)
+
+// apiKey is a key that authenticates requests.
+// Only the key's hash is stored, the key itself is shown once when it's added.
+type apiKey struct {
+	ID        string
+	Name      string
+	Scopes    []string  // Endpoints the key may call, like clientACL's endpoints
+	ExpiresAt time.Time // Zero if it never expires
+	Enabled   bool
+	CreatedAt time.Time
+}
+
+// keyStore holds the API keys in a sidecar SQLite database
+type keyStore struct {
+	db *sql.DB
+}
+
+func openKeyStore(keysPath string) (*keyStore, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=rwc&_journal_mode=WAL&_busy_timeout=5000", keysPath))
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS api_keys (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		expires_at INTEGER,
+		enabled INTEGER NOT NULL DEFAULT 1,
+		created_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Cannot init API keys database '%s': %v", keysPath, err)
+	}
+
+	return &keyStore{db: db}, nil
+}
+
+func (store *keyStore) close() {
+	store.db.Close()
+}
+
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// add creates a key for name, that may call scopes until expiresAt (zero means never).
+// It returns the key, which isn't stored and can't be shown again.
+func (store *keyStore) add(name string, scopes []string, expiresAt time.Time) (string, apiKey, error) {
+	if name == "" {
+		return "", apiKey{}, fmt.Errorf("API key must have a name")
+	}
+	if len(scopes) == 0 {
+		return "", apiKey{}, fmt.Errorf("API key must have at least one scope")
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return "", apiKey{}, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", apiKey{}, err
+	}
+	key := "sqs_" + secret
+
+	scopesJSON, err := json.Marshal(scopes)
+	if err != nil {
+		return "", apiKey{}, err
+	}
+
+	var expiresAtUnix interface{}
+	if !expiresAt.IsZero() {
+		expiresAtUnix = expiresAt.Unix()
+	}
+
+	createdAt := time.Now()
+	_, err = store.db.Exec("INSERT INTO api_keys (id, name, key_hash, scopes, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		id, name, hashAPIKey(key), string(scopesJSON), expiresAtUnix, createdAt.Unix())
+	if err != nil {
+		return "", apiKey{}, err
+	}
+
+	return key, apiKey{ID: id, Name: name, Scopes: scopes, ExpiresAt: expiresAt, Enabled: true, CreatedAt: createdAt}, nil
+}
+
+// revoke disables the key with id
+func (store *keyStore) revoke(id string) error {
+	result, err := store.db.Exec("UPDATE api_keys SET enabled = 0 WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("API key '%s' doesn't exist", id)
+	}
+	return nil
+}
+
+const apiKeyColumns = "id, name, scopes, expires_at, enabled, created_at"
+
+func scanAPIKey(scanner interface{ Scan(...interface{}) error }) (apiKey, error) {
+	var key apiKey
+	var scopesJSON string
+	var expiresAt sql.NullInt64
+	var createdAt int64
+
+	err := scanner.Scan(&key.ID, &key.Name, &scopesJSON, &expiresAt, &key.Enabled, &createdAt)
+	if err != nil {
+		return apiKey{}, err
+	}
+
+	err = json.Unmarshal([]byte(scopesJSON), &key.Scopes)
+	if err != nil {
+		return apiKey{}, err
+	}
+	if expiresAt.Valid {
+		key.ExpiresAt = time.Unix(expiresAt.Int64, 0)
+	}
+	key.CreatedAt = time.Unix(createdAt, 0)
+
+	return key, nil
+}
+
+func (store *keyStore) list() ([]apiKey, error) {
+	rows, err := store.db.Query("SELECT " + apiKeyColumns + " FROM api_keys ORDER BY created_at, rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []apiKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// apiKeyError is the reason a key doesn't authenticate a request
+type apiKeyError struct {
+	message string
+}
+
+func (err *apiKeyError) Error() string {
+	return err.message
+}
+
+// authenticate returns the stored key of key, if it's enabled and unexpired.
+// It returns an *apiKeyError if it isn't.
+func (store *keyStore) authenticate(key string) (apiKey, error) {
+	storedKey, err := scanAPIKey(store.db.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = ?", hashAPIKey(key)))
+	if err == sql.ErrNoRows {
+		return apiKey{}, &apiKeyError{"Invalid API key"}
+	} else if err != nil {
+		return apiKey{}, fmt.Errorf("Cannot read API keys: %v", err)
+	}
+
+	if !storedKey.Enabled {
+		return apiKey{}, &apiKeyError{fmt.Sprintf("API key '%s' is revoked", storedKey.ID)}
+	}
+	if !storedKey.ExpiresAt.IsZero() && time.Now().After(storedKey.ExpiresAt) {
+		return apiKey{}, &apiKeyError{fmt.Sprintf("API key '%s' expired at %s", storedKey.ID, storedKey.ExpiresAt.UTC().Format(time.RFC3339))}
+	}
+
+	return storedKey, nil
+}
+
+// allows reports whether the key may call the endpoint at path
+func (key apiKey) allows(path string) bool {
+	return endpointAllowed(key.Scopes, path)
+}
+
+// requestAPIKey returns the API key of the request,
+// from the "Authorization: Bearer" header or the "X-API-Key" header
+func requestAPIKey(r *http.Request) string {
+	if authorization := r.Header.Get("Authorization"); len(authorization) > len("Bearer ") && strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(authorization[len("Bearer "):])
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// keysCmd manages the API keys: "keys --keys-db <path> add|revoke|list ..."
+func keysCmd(cmdArgs []string, out io.Writer) error {
+	var flagSet = flag.NewFlagSet("keys flags", flag.ContinueOnError)
+
+	var keysPath string
+	flagSet.StringVar(&keysPath, "keys-db", "", "Filesystem path of the SQLite database of the API keys (created if missing)")
+
+	err := flagSet.Parse(cmdArgs)
+	if err != nil {
+		return err
+	}
+	if keysPath == "" {
+		return fmt.Errorf("Must provide --keys-db param")
+	}
+	if flagSet.NArg() == 0 {
+		return fmt.Errorf("Must provide a keys command: add, revoke or list")
+	}
+
+	store, err := openKeyStore(keysPath)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+
+	command, commandArgs := flagSet.Arg(0), flagSet.Args()[1:]
+	switch command {
+	case "add":
+		var addFlagSet = flag.NewFlagSet("keys add flags", flag.ContinueOnError)
+
+		var name string
+		var scopes string
+		var expiresIn time.Duration
+		addFlagSet.StringVar(&name, "name", "", "Name of the key's owner, it's the identity of its requests")
+		addFlagSet.StringVar(&scopes, "scopes", "", "Comma separated endpoints the key may call (e.g. /query,/q/,/stats), * for all")
+		addFlagSet.DurationVar(&expiresIn, "expires-in", 0, "Duration until the key expires (e.g. 720h), 0 means never")
+
+		err = addFlagSet.Parse(commandArgs)
+		if err != nil {
+			return err
+		}
+
+		var expiresAt time.Time
+		if expiresIn > 0 {
+			expiresAt = time.Now().Add(expiresIn)
+		}
+
+		key, storedKey, err := store.add(name, splitList(scopes), expiresAt)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "Added API key '%s' for '%s', it's shown only once:\n%s\n", storedKey.ID, storedKey.Name, key)
+		return nil
+	case "revoke":
+		if len(commandArgs) != 1 {
+			return fmt.Errorf("Must provide the ID of the key to revoke")
+		}
+
+		err = store.revoke(commandArgs[0])
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "Revoked API key '%s'\n", commandArgs[0])
+		return nil
+	case "list":
+		keys, err := store.list()
+		if err != nil {
+			return err
+		}
+
+		table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "ID\tNAME\tSCOPES\tEXPIRES\tENABLED\tCREATED")
+		for _, key := range keys {
+			expires := "never"
+			if !key.ExpiresAt.IsZero() {
+				expires = key.ExpiresAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%v\t%s\n", key.ID, key.Name, strings.Join(key.Scopes, ","), expires, key.Enabled, key.CreatedAt.UTC().Format(time.RFC3339))
+		}
+		return table.Flush()
+	}
+
+	return fmt.Errorf("Unknown keys command '%s', must be one of: add, revoke, list", command)
+}
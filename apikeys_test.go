@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyStore(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "apikeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store, err := openKeyStore(filepath.Join(tmpDir, "keys.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	key, addedKey, err := store.add("billing", []string{"/query"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, "sqs_") {
+		t.Fatalf(`key (%s) should start with "sqs_"`, key)
+	}
+
+	storedKey, err := store.authenticate(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storedKey.ID != addedKey.ID || storedKey.Name != "billing" {
+		t.Fatalf(`authenticate() (%+v) != add() (%+v)`, storedKey, addedKey)
+	}
+	if !storedKey.allows("/query") || storedKey.allows("/stats") {
+		t.Fatalf(`key with scopes %v should allow only "/query"`, storedKey.Scopes)
+	}
+
+	_, err = store.authenticate(key + "0")
+	if _, ok := err.(*apiKeyError); !ok {
+		t.Fatalf(`authenticate() of an unknown key should fail with *apiKeyError, got %v`, err)
+	}
+
+	expiredKey, _, err := store.add("old", []string{"*"}, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.authenticate(expiredKey)
+	if err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf(`authenticate() of an expired key should fail, got %v`, err)
+	}
+
+	err = store.revoke(addedKey.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.authenticate(key)
+	if err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Fatalf(`authenticate() of a revoked key should fail, got %v`, err)
+	}
+
+	err = store.revoke("nope")
+	if err == nil {
+		t.Fatal(`revoke() of an unknown key should fail`)
+	}
+
+	keys, err := store.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Enabled {
+		t.Fatalf(`list() (%+v) should have the revoked key and the expired key`, keys)
+	}
+
+	_, _, err = store.add("", []string{"*"}, time.Time{})
+	if err == nil {
+		t.Fatal(`add() without a name should fail`)
+	}
+	_, _, err = store.add("billing", nil, time.Time{})
+	if err == nil {
+		t.Fatal(`add() without scopes should fail`)
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "apikeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keysPath := filepath.Join(tmpDir, "keys.db")
+	store, err := openKeyStore(keysPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	billingKey, _, err := store.add("billing", []string{"/query"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.close()
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withKeyStore(keysPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		header     string
+		key        string
+		path       string
+		statusCode int
+	}{
+		{"Authorization", "Bearer " + billingKey, "/query?p=github.com", http.StatusOK},
+		{"Authorization", "bearer " + billingKey, "/query?p=github.com", http.StatusOK},
+		{"X-API-Key", billingKey, "/query?p=github.com", http.StatusOK},
+		{"X-API-Key", billingKey, "/stats", http.StatusForbidden},
+		{"X-API-Key", "sqs_nope", "/query?p=github.com", http.StatusUnauthorized},
+		{"Authorization", "Basic " + billingKey, "/query?p=github.com", http.StatusUnauthorized},
+		{"", "", "/query?p=github.com", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "http://example.org"+test.path, nil)
+		if test.header != "" {
+			req.Header.Set(test.header, test.key)
+		}
+		w := httptest.NewRecorder()
+		queryHandler(w, req)
+
+		resp := w.Result()
+		if resp.StatusCode != test.statusCode {
+			t.Fatalf(`%s: %s %s: resp.StatusCode (%d) != %d`, test.path, test.header, test.key, resp.StatusCode, test.statusCode)
+		}
+		if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Fatalf(`%s: %s %s: 401 response should have a WWW-Authenticate header`, test.path, test.header, test.key)
+		}
+	}
+}
+
+func TestAPIKeyAccessLog(t *testing.T) {
+	logs := &bytes.Buffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "apikeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keysPath := filepath.Join(tmpDir, "keys.db")
+	store, err := openKeyStore(keysPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := store.add("billing", []string{"*"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.close()
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withKeyStore(keysPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://example.org/query?p=github.com", nil)
+	req.Header.Set("X-API-Key", key)
+	accessLog(http.HandlerFunc(queryHandler)).ServeHTTP(httptest.NewRecorder(), req)
+
+	if !strings.Contains(logs.String(), " billing GET /query?p=github.com 200 ") {
+		t.Fatalf(`access log (%s) should have the key's name as the identity`, logs.String())
+	}
+}
+
+func TestKeysCmd(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "apikeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keysPath := filepath.Join(tmpDir, "keys.db")
+
+	out := &bytes.Buffer{}
+	err = keysCmd([]string{"--keys-db", keysPath, "add", "--name", "billing", "--scopes", "/query, /q/", "--expires-in", "720h"}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	key := lines[len(lines)-1]
+
+	store, err := openKeyStore(keysPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storedKey, err := store.authenticate(key)
+	store.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(storedKey.Scopes, ",") != "/query,/q/" || storedKey.ExpiresAt.IsZero() {
+		t.Fatalf(`added key (%+v) should have the scopes and the expiry of the command`, storedKey)
+	}
+
+	out.Reset()
+	err = keysCmd([]string{"--keys-db", keysPath, "list"}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), storedKey.ID) || !strings.Contains(out.String(), "billing") || strings.Contains(out.String(), key) {
+		t.Fatalf(`list output (%s) should have the key's ID and name, but not the key`, out.String())
+	}
+
+	err = keysCmd([]string{"--keys-db", keysPath, "revoke", storedKey.ID}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = keysCmd([]string{"--keys-db", keysPath, "rotate"}, &bytes.Buffer{})
+	if err == nil {
+		t.Fatal(`keysCmd() with an unknown command should fail`)
+	}
+	err = keysCmd([]string{"list"}, &bytes.Buffer{})
+	if err == nil {
+		t.Fatal(`keysCmd() without --keys-db should fail`)
+	}
+}
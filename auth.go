@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// authenticate authenticates the request by its signature, its API key or its JWT, if any of them
+// is enabled, and returns the request's identity (certIdentity if none is enabled) and the params
+// bound from its credentials. If the request isn't authenticated it responds and returns false.
+func (server *queryServer) authenticate(w http.ResponseWriter, r *http.Request, certIdentity string) (string, []sql.NamedArg, bool) {
+	if server.signatures != nil && isSigned(r) {
+		keyID, ok := server.authenticateSignature(w, r)
+		return keyID, nil, ok
+	}
+
+	if server.keys == nil && server.jwtVerifier == nil {
+		if server.signatures != nil {
+			w.Header().Set("WWW-Authenticate", `HMAC-SHA256 realm="SQLiteQueryServer"`)
+			http.Error(w, fmt.Sprintf("\n\n%s is required\n\n%s", server.credentialsName(), server.helpMessage), http.StatusUnauthorized)
+			return "", nil, false
+		}
+		return certIdentity, nil, true
+	}
+
+	token := requestAPIKey(r)
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="SQLiteQueryServer"`)
+		http.Error(w, fmt.Sprintf("\n\n%s is required\n\n%s", server.credentialsName(), server.helpMessage), http.StatusUnauthorized)
+		return "", nil, false
+	}
+
+	if server.jwtVerifier != nil && (isJWT(token) || server.keys == nil) {
+		claims, err := server.jwtVerifier.verify(token, time.Now())
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="SQLiteQueryServer", error="invalid_token"`)
+			http.Error(w, fmt.Sprintf("\n\n%v\n\n%s", err, server.helpMessage), http.StatusUnauthorized)
+			return "", nil, false
+		}
+
+		boundParams, err := server.jwtVerifier.boundParams(claims)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("\n\n%v\n\n%s", err, server.helpMessage), http.StatusForbidden)
+			return "", nil, false
+		}
+
+		return server.jwtVerifier.identity(claims), boundParams, true
+	}
+
+	storedKey, err := server.keys.authenticate(token)
+	if _, ok := err.(*apiKeyError); ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="SQLiteQueryServer", error="invalid_token"`)
+		http.Error(w, fmt.Sprintf("\n\n%v\n\n%s", err, server.helpMessage), http.StatusUnauthorized)
+		return "", nil, false
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("\n\nError authenticating API key: %v\n\n%s", err, server.helpMessage), http.StatusInternalServerError)
+		return "", nil, false
+	}
+
+	if !storedKey.allows(r.URL.Path) {
+		http.Error(w, fmt.Sprintf("\n\nAPI key '%s' isn't allowed to call '%s'\n\n%s", storedKey.ID, r.URL.Path, server.helpMessage), http.StatusForbidden)
+		return "", nil, false
+	}
+
+	return storedKey.Name, nil, true
+}
+
+// credentialsName names the credentials that requests must present
+func (server *queryServer) credentialsName() string {
+	var names []string
+	if server.signatures != nil {
+		names = append(names, "Request signature")
+	}
+	if server.keys != nil {
+		names = append(names, "API key")
+	}
+	if server.jwtVerifier != nil {
+		names = append(names, "JWT")
+	}
+	return strings.Join(names, " or ")
+}
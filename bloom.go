@@ -0,0 +1,337 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// bloomFilter is a Bloom filter of strings.
+// It has no false negatives, and false positives at about the rate it was built for.
+type bloomFilter struct {
+	bits    []uint64
+	m       uint64 // Number of bits
+	k       uint64 // Number of hash functions
+	entries uint64
+}
+
+func newBloomFilter(expectedEntries uint64, falsePositiveRate float64) *bloomFilter {
+	if expectedEntries == 0 {
+		expectedEntries = 1
+	}
+
+	// Optimal bits count and hash functions count
+	m := uint64(math.Ceil(-float64(expectedEntries) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Round(float64(m) / float64(expectedEntries) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+
+	return &bloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// positions returns the k bit positions of key, using double hashing
+func (filter *bloomFilter) positions(key string) []uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	sum := hash.Sum64()
+
+	h1 := sum & 0xffffffff
+	h2 := sum >> 32
+
+	positions := make([]uint64, filter.k)
+	for i := uint64(0); i < filter.k; i++ {
+		positions[i] = (h1 + i*h2) % filter.m
+	}
+	return positions
+}
+
+func (filter *bloomFilter) add(key string) {
+	for _, position := range filter.positions(key) {
+		filter.bits[position/64] |= 1 << (position % 64)
+	}
+	filter.entries++
+}
+
+func (filter *bloomFilter) mayContain(key string) bool {
+	for _, position := range filter.positions(key) {
+		if filter.bits[position/64]&(1<<(position%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// falsePositiveRate estimates the false positive rate of the filter
+func (filter *bloomFilter) falsePositiveRate() float64 {
+	return math.Pow(1-math.Exp(-float64(filter.k)*float64(filter.entries)/float64(filter.m)), float64(filter.k))
+}
+
+// keyFilter skips executions of the query for params that can't match any row,
+// using a Bloom filter of the values of a key column.
+// It is rebuilt in the background when the database changes,
+// and it doesn't skip anything until it's rebuilt.
+type keyFilter struct {
+	table             string
+	column            string
+	paramIndex        int // 0-based index of the param that is compared to the key column
+	falsePositiveRate float64
+
+	mutex      sync.RWMutex
+	filter     *bloomFilter
+	version    string   // The database version that the filter was built for
+	headers    []string // The query's columns, for the skipped results
+	rebuilding bool
+
+	checks  uint64
+	skipped uint64
+}
+
+// bloomStats are reported in "/stats"
+type bloomStats struct {
+	Key                     string  `json:"key"`
+	Entries                 uint64  `json:"entries"`
+	SizeBytes               uint64  `json:"size_bytes"`
+	Hashes                  uint64  `json:"hashes"`
+	TargetFalsePositiveRate float64 `json:"target_false_positive_rate"`
+	FalsePositiveRate       float64 `json:"false_positive_rate"`
+	Checks                  uint64  `json:"checks"`
+	Skipped                 uint64  `json:"skipped"`
+	Ready                   bool    `json:"ready"`
+}
+
+// initKeyFilter builds a filter of key ("table.column"),
+// for the param at paramIndex (1-based) of the query.
+// dbVersion is the current database version, see dataVersion().
+func initKeyFilter(db *sql.DB, key string, paramIndex int, falsePositiveRate float64, dbVersion string) (*keyFilter, error) {
+	dot := strings.LastIndex(key, ".")
+	if dot <= 0 || dot == len(key)-1 {
+		return nil, fmt.Errorf("Bloom filter key '%s' must be 'table.column'", key)
+	}
+	if paramIndex < 1 {
+		return nil, fmt.Errorf("Bloom filter param must be a positive param index, got %d", paramIndex)
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil, fmt.Errorf("Bloom filter false positive rate must be between 0 and 1, got %v", falsePositiveRate)
+	}
+
+	kf := &keyFilter{
+		table:             key[:dot],
+		column:            key[dot+1:],
+		paramIndex:        paramIndex - 1,
+		falsePositiveRate: falsePositiveRate,
+	}
+
+	// SQLite treats a double quoted identifier that doesn't exist as a string literal,
+	// so make sure that the key column really exists
+	var declaredType string
+	err := db.QueryRow("SELECT type FROM pragma_table_info(?) WHERE name = ?", kf.table, kf.column).Scan(&declaredType)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("Cannot build Bloom filter for '%s': no such table or column", key)
+	} else if err != nil {
+		return nil, fmt.Errorf("Cannot build Bloom filter for '%s': %v", key, err)
+	}
+
+	// The filter has the values as they are stored, and it's checked with the params as they are sent,
+	// so the column must compare them as is: a param isn't converted to a TEXT or BLOB column's type,
+	// but it is converted to a numeric one (e.g. '042' = 42), and BINARY is the only collation that
+	// doesn't match different strings (e.g. 'a' = 'A' with NOCASE)
+	affinity := columnAffinity(declaredType)
+	if affinity != "TEXT" && affinity != "BLOB" {
+		return nil, fmt.Errorf("Cannot build Bloom filter for '%s': the column has %s affinity, only TEXT or BLOB (or no type) columns are supported", key, affinity)
+	}
+	var binary bool
+	err = db.QueryRow(fmt.Sprintf("SELECT NOT (v = 'A' OR v = 'a ') FROM (SELECT %s AS v FROM %s WHERE 0 UNION ALL SELECT 'a')",
+		quoteIdentifier(kf.column), quoteIdentifier(kf.table))).Scan(&binary)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot build Bloom filter for '%s': %v", key, err)
+	}
+	if !binary {
+		return nil, fmt.Errorf("Cannot build Bloom filter for '%s': the column has a COLLATE, only BINARY columns are supported", key)
+	}
+
+	err = kf.rebuild(db, dbVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	return kf, nil
+}
+
+// columnAffinity returns the affinity of a column of declaredType, by SQLite's rules
+func columnAffinity(declaredType string) string {
+	declaredType = strings.ToUpper(declaredType)
+	switch {
+	case strings.Contains(declaredType, "INT"):
+		return "INTEGER"
+	case strings.Contains(declaredType, "CHAR"), strings.Contains(declaredType, "CLOB"), strings.Contains(declaredType, "TEXT"):
+		return "TEXT"
+	case strings.Contains(declaredType, "BLOB"), declaredType == "":
+		return "BLOB"
+	case strings.Contains(declaredType, "REAL"), strings.Contains(declaredType, "FLOA"), strings.Contains(declaredType, "DOUB"):
+		return "REAL"
+	default:
+		return "NUMERIC"
+	}
+}
+
+func quoteIdentifier(identifier string) string {
+	return `"` + strings.Replace(identifier, `"`, `""`, -1) + `"`
+}
+
+// rebuild builds a new filter from the key column of db, which is at version
+func (kf *keyFilter) rebuild(db *sql.DB, version string) error {
+	var count uint64
+	err := db.QueryRow(fmt.Sprintf("SELECT count(DISTINCT %s) FROM %s", quoteIdentifier(kf.column), quoteIdentifier(kf.table))).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("Cannot build Bloom filter for '%s.%s': %v", kf.table, kf.column, err)
+	}
+
+	filter := newBloomFilter(count, kf.falsePositiveRate)
+
+	rows, err := db.Query(fmt.Sprintf("SELECT DISTINCT %s FROM %s WHERE %s IS NOT NULL", quoteIdentifier(kf.column), quoteIdentifier(kf.table), quoteIdentifier(kf.column)))
+	if err != nil {
+		return fmt.Errorf("Cannot build Bloom filter for '%s.%s': %v", kf.table, kf.column, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var value interface{}
+		err = rows.Scan(&value)
+		if err != nil {
+			return fmt.Errorf("Cannot build Bloom filter for '%s.%s': %v", kf.table, kf.column, err)
+		}
+		filter.add(bloomKey(value))
+	}
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("Cannot build Bloom filter for '%s.%s': %v", kf.table, kf.column, err)
+	}
+
+	kf.mutex.Lock()
+	kf.filter = filter
+	kf.version = version
+	kf.mutex.Unlock()
+
+	return nil
+}
+
+// bloomKey converts a value of the key column to the string it's compared as
+func bloomKey(value interface{}) string {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// skip returns true if the query can't return any rows for queryParams,
+// along with the query's columns for the empty result.
+// handle is the database that the request holds, and dbVersion is its version, see dataVersion().
+// A nil keyFilter never skips.
+func (kf *keyFilter) skip(handle *dbHandle, dbVersion string, queryParams []interface{}) ([]string, bool) {
+	if kf == nil || kf.paramIndex >= len(queryParams) {
+		return nil, false
+	}
+	param, ok := queryParams[kf.paramIndex].(string)
+	if !ok {
+		// e.g. a named param
+		return nil, false
+	}
+
+	kf.mutex.RLock()
+	filter, version, headers := kf.filter, kf.version, kf.headers
+	kf.mutex.RUnlock()
+
+	if version != dbVersion {
+		kf.rebuildInBackground(handle, dbVersion)
+		return nil, false
+	}
+	if headers == nil {
+		// Headers are known only after the query is executed once
+		return nil, false
+	}
+
+	atomic.AddUint64(&kf.checks, 1)
+	if filter.mayContain(param) {
+		return nil, false
+	}
+
+	atomic.AddUint64(&kf.skipped, 1)
+	return headers, true
+}
+
+// setHeaders sets the query's columns, once they are known
+func (kf *keyFilter) setHeaders(headers []string) {
+	if kf == nil || headers == nil {
+		return
+	}
+
+	kf.mutex.Lock()
+	defer kf.mutex.Unlock()
+
+	if kf.headers == nil {
+		kf.headers = headers
+	}
+}
+
+// rebuildInBackground rebuilds the filter from the database of handle, which is at dbVersion.
+// The rebuild holds handle, so its database isn't closed underneath it after a swap.
+func (kf *keyFilter) rebuildInBackground(handle *dbHandle, dbVersion string) {
+	kf.mutex.Lock()
+	if kf.rebuilding {
+		kf.mutex.Unlock()
+		return
+	}
+	kf.rebuilding = true
+	kf.mutex.Unlock()
+
+	// The request that calls it holds handle too
+	handle.requests.Add(1)
+	go func() {
+		defer handle.release()
+
+		log.Printf("Database changed, rebuilding Bloom filter for '%s.%s'...\n", kf.table, kf.column)
+
+		err := kf.rebuild(handle.db, dbVersion)
+		if err != nil {
+			log.Println(err)
+		}
+
+		kf.mutex.Lock()
+		kf.rebuilding = false
+		kf.mutex.Unlock()
+	}()
+}
+
+func (kf *keyFilter) stats() bloomStats {
+	kf.mutex.RLock()
+	defer kf.mutex.RUnlock()
+
+	return bloomStats{
+		Key:                     kf.table + "." + kf.column,
+		Entries:                 kf.filter.entries,
+		SizeBytes:               uint64(len(kf.filter.bits)) * 8,
+		Hashes:                  kf.filter.k,
+		TargetFalsePositiveRate: kf.falsePositiveRate,
+		FalsePositiveRate:       kf.filter.falsePositiveRate(),
+		Checks:                  atomic.LoadUint64(&kf.checks),
+		Skipped:                 atomic.LoadUint64(&kf.skipped),
+		Ready:                   kf.headers != nil && !kf.rebuilding,
+	}
+}
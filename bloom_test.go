@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	json "github.com/json-iterator/go"
+)
+
+func TestBloomFilterNoFalseNegatives(t *testing.T) {
+	filter := newBloomFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		filter.add(fmt.Sprintf("key%d", i))
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !filter.mayContain(fmt.Sprintf("key%d", i)) {
+			t.Fatalf(`filter.mayContain("key%d") should be true`, i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 1000; i < 11000; i++ {
+		if filter.mayContain(fmt.Sprintf("key%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Fatalf(`Too many false positives: %d/10000`, falsePositives)
+	}
+}
+
+func TestBloomFilterSkipsQueries(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withBloomFilter("ip_dns.dns", 1, 0.0001))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqString := "github.com\nnot.there.com\none.one.one.one\nalso.not.there.com"
+
+	req := httptest.NewRequest("POST",
+		"http://example.org/query",
+		strings.NewReader(reqString))
+	w := httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+	}
+
+	var fullResponse []queryResult
+	err = json.NewDecoder(resp.Body).Decode(&fullResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedResponse := []queryResult{
+		{
+			Out: [][]interface{}{
+				{"192.30.253.112", "github.com"},
+				{"192.30.253.113", "github.com"},
+			}},
+		{
+			Out: [][]interface{}{}},
+		{
+			Out: [][]interface{}{
+				{"1.1.1.1", "one.one.one.one"},
+			}},
+		{
+			Out: [][]interface{}{}},
+	}
+
+	compare(t, fullResponse, expectedResponse)
+
+	for i := range fullResponse {
+		if len(fullResponse[i].Headers) != 2 {
+			t.Fatalf(`len(fullResponse[%d].Headers) != 2`, i)
+		}
+	}
+
+	bloomStats := getStats(t, queryHandler).Bloom
+	if bloomStats == nil {
+		t.Fatal(`Stats should have Bloom filter stats`)
+	}
+	if bloomStats.Entries != 3 {
+		t.Fatalf(`bloomStats.Entries (%d) != 3`, bloomStats.Entries)
+	}
+	if bloomStats.Skipped != 2 {
+		t.Fatalf(`bloomStats.Skipped (%d) != 2`, bloomStats.Skipped)
+	}
+}
+
+func TestBloomFilterBadKey(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	for _, key := range []string{"ip_dns", "ip_dns.banana", "banana.dns"} {
+		_, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withBloomFilter(key, 1, 0.01))
+		if err == nil {
+			t.Fatalf(`Bloom filter key "%s" should throw an error`, key)
+		}
+	}
+}
+
+func TestBloomFilterColumnTypes(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "bloom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbPath := filepath.Join(tmpDir, "keys.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE t (i INTEGER, r DOUBLE, n DECIMAL(10,2), tx TEXT, vc VARCHAR(10), nc TEXT COLLATE NOCASE, rt TEXT COLLATE RTRIM, b BLOB, none);
+		INSERT INTO t VALUES (42, 4.2, 42, 'a', 'a', 'a', 'a', x'61', 'a');`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for column, supported := range map[string]bool{
+		"i":    false,
+		"r":    false,
+		"n":    false,
+		"tx":   true,
+		"vc":   true,
+		"nc":   false,
+		"rt":   false,
+		"b":    true,
+		"none": true,
+	} {
+		_, err := initQueryHandler(dbPath, fmt.Sprintf("SELECT * FROM t WHERE %s = ?", column), 0, withBloomFilter("t."+column, 1, 0.01))
+		if supported && err != nil {
+			t.Fatalf(`Bloom filter of column "%s" should be supported: %v`, column, err)
+		} else if !supported && err == nil {
+			t.Fatalf(`Bloom filter of column "%s" should throw an error`, column)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var namedParamRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// queryNamedParams returns the names of the ":name", "@name" and "$name" params of queryString
+func queryNamedParams(queryString string) map[string]bool {
+	names := map[string]bool{}
+	for _, name := range queryParamLayout(queryString) {
+		if name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// queryParamLayout returns the name of each of the params of queryString by its index,
+// "" for a positional ("?" or "?NNN") param, like SQLite numbers them: "?NNN" is param NNN,
+// and "?" or the first occurrence of a name is the param after the largest index so far.
+// String literals, quoted identifiers and comments are skipped.
+func queryParamLayout(queryString string) []string {
+	var layout []string
+	seen := map[string]bool{}
+
+	for i := 0; i < len(queryString); i++ {
+		switch c := queryString[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			for i++; i < len(queryString) && queryString[i] != c; i++ {
+			}
+		case c == '[':
+			for i++; i < len(queryString) && queryString[i] != ']'; i++ {
+			}
+		case c == '-' && i+1 < len(queryString) && queryString[i+1] == '-':
+			for i += 2; i < len(queryString) && queryString[i] != '\n'; i++ {
+			}
+		case c == '/' && i+1 < len(queryString) && queryString[i+1] == '*':
+			for i += 2; i+1 < len(queryString) && !(queryString[i] == '*' && queryString[i+1] == '/'); i++ {
+			}
+			i++
+		case c == '?':
+			end := i + 1
+			for end < len(queryString) && queryString[end] >= '0' && queryString[end] <= '9' {
+				end++
+			}
+			if end == i+1 {
+				layout = append(layout, "")
+			} else if index, err := strconv.Atoi(queryString[i+1 : end]); err == nil && index > 0 && index <= maxParams {
+				for len(layout) < index {
+					layout = append(layout, "")
+				}
+			}
+			i = end - 1
+		case c == ':' || c == '@' || c == '$':
+			end := i + 1
+			for end < len(queryString) && isParamNameChar(queryString[end]) {
+				end++
+			}
+			if name := queryString[i+1 : end]; name != "" && !seen[name] {
+				seen[name] = true
+				layout = append(layout, name)
+			}
+			i = end - 1
+		case isParamNameChar(c):
+			// A keyword, identifier or number, which may contain '$'
+			for i+1 < len(queryString) && isParamNameChar(queryString[i+1]) {
+				i++
+			}
+		}
+	}
+
+	return layout
+}
+
+// The largest param index of SQLite (SQLITE_MAX_VARIABLE_NUMBER)
+const maxParams = 32766
+
+func isParamNameChar(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80
+}
+
+// Sources of request params, besides "header:<name>"
+const (
+	requestParamClientIP = "client_ip"
+	requestParamIdentity = "identity"
+	requestParamNow      = "now"
+	requestParamNowUnix  = "now_unix"
+)
+
+// requestParam is a named param that is filled from the request's metadata
+type requestParam struct {
+	name   string
+	source string // One of the requestParam* consts, or "header"
+	header string // The header's name if source is "header"
+}
+
+// parseRequestParam parses "name=source", where source is "header:<name>",
+// "client_ip", "identity", "now" or "now_unix"
+func parseRequestParam(bindParam string) (requestParam, error) {
+	eq := strings.Index(bindParam, "=")
+	if eq == -1 {
+		return requestParam{}, fmt.Errorf("Bound param '%s' must be 'name=source'", bindParam)
+	}
+
+	param := requestParam{
+		name:   strings.TrimSpace(bindParam[:eq]),
+		source: strings.TrimSpace(bindParam[eq+1:]),
+	}
+	if !namedParamRegex.MatchString(param.name) {
+		return requestParam{}, fmt.Errorf("Invalid bound param name '%s'", param.name)
+	}
+
+	switch {
+	case strings.HasPrefix(param.source, "header:"):
+		param.header = strings.TrimSpace(strings.TrimPrefix(param.source, "header:"))
+		param.source = "header"
+		if param.header == "" {
+			return requestParam{}, fmt.Errorf("Bound param '%s' must name a header, e.g. 'header:X-Request-Id'", bindParam)
+		}
+	case param.source == requestParamClientIP, param.source == requestParamIdentity, param.source == requestParamNow, param.source == requestParamNowUnix:
+	default:
+		return requestParam{}, fmt.Errorf("Unknown source '%s' of bound param '%s', must be one of: header:<name>, client_ip, identity, now, now_unix", param.source, param.name)
+	}
+
+	return param, nil
+}
+
+// requestParams returns the values of params for request r of identity ("" if none) from clientIP at now.
+// A missing header or identity is NULL.
+func requestParams(params []requestParam, r *http.Request, identity string, clientIP string, now time.Time) []sql.NamedArg {
+	boundParams := make([]sql.NamedArg, 0, len(params))
+	for _, param := range params {
+		var value interface{}
+		switch param.source {
+		case "header":
+			if values, ok := r.Header[http.CanonicalHeaderKey(param.header)]; ok {
+				value = strings.Join(values, ", ")
+			}
+		case requestParamClientIP:
+			value = clientIP
+		case requestParamIdentity:
+			if identity != "" {
+				value = identity
+			}
+		case requestParamNow:
+			// The format of SQLite's datetime('now')
+			value = now.UTC().Format("2006-01-02 15:04:05")
+		case requestParamNowUnix:
+			value = now.Unix()
+		}
+		boundParams = append(boundParams, sql.Named(param.name, value))
+	}
+	return boundParams
+}
+
+// bindParams returns the bound params that query has.
+// Bound params are set by the server (e.g. from JWT claims or the request's metadata), never by the request.
+func bindParams(query *preparedQuery, boundParams []sql.NamedArg) []sql.NamedArg {
+	queryParams := make([]sql.NamedArg, 0, len(boundParams))
+	for _, param := range boundParams {
+		if query.namedParams[param.Name] {
+			queryParams = append(queryParams, param)
+		}
+	}
+	return queryParams
+}
+
+// checkBoundParams returns an error if the URL query string tries to set a bound param
+// or a claim param (see jwtVerifier.claimParamNames())
+func checkBoundParams(urlQuery url.Values, boundParams []sql.NamedArg, claimParams []string) error {
+	for _, param := range boundParams {
+		if _, ok := urlQuery[param.Name]; ok {
+			return fmt.Errorf("Param ':%s' is set by the server and can't be set by the request", param.Name)
+		}
+	}
+	for _, name := range claimParams {
+		if _, ok := urlQuery[name]; ok {
+			return fmt.Errorf("Param ':%s' is set by the server and can't be set by the request", name)
+		}
+	}
+	return nil
+}
+
+// checkClaimParams returns an error if query has a claim param that isn't bound,
+// because the request wasn't authenticated with a JWT
+func checkClaimParams(query *preparedQuery, boundParams []sql.NamedArg, claimParams []string) error {
+	for _, name := range claimParams {
+		if !query.namedParams[name] {
+			continue
+		}
+		bound := false
+		for _, param := range boundParams {
+			if param.Name == name {
+				bound = true
+				break
+			}
+		}
+		if !bound {
+			return fmt.Errorf("Param ':%s' is set from a JWT claim, the request must be authenticated with a JWT", name)
+		}
+	}
+	return nil
+}
+
+// bindArgs returns the args of query for the positional params (e.g. the fields of a CSV line)
+// and the named params, with each positional value at the index of an unnamed param of the query,
+// so that a named param before a "?" doesn't take its value.
+// Named params that the query doesn't have are ignored.
+func bindArgs(query *preparedQuery, positional []interface{}, named []sql.NamedArg) ([]interface{}, error) {
+	if query.paramLayout == nil {
+		// The layout of the params is unknown, the driver binds them by their order
+		args := append([]interface{}{}, positional...)
+		for _, param := range named {
+			args = append(args, param)
+		}
+		return args, nil
+	}
+
+	positionalCount := 0
+	for _, name := range query.paramLayout {
+		if name == "" {
+			positionalCount++
+		}
+	}
+	if len(positional) != positionalCount {
+		return nil, fmt.Errorf("sql: expected %d arguments, got %d", positionalCount, len(positional))
+	}
+
+	args := make([]interface{}, len(query.paramLayout))
+	next := 0
+	for i, name := range query.paramLayout {
+		if name == "" {
+			args[i] = positional[next]
+			next++
+			continue
+		}
+
+		found := false
+		for _, param := range named {
+			if param.Name == name {
+				args[i] = param
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Param ':%s' is missing", name)
+		}
+	}
+	return args, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	json "github.com/json-iterator/go"
+)
+
+func TestParseRequestParam(t *testing.T) {
+	for _, bindParam := range []string{"caller=identity", "ip = client_ip", "at=now", "at=now_unix", "trace=header:X-Trace-Id"} {
+		_, err := parseRequestParam(bindParam)
+		if err != nil {
+			t.Fatalf(`parseRequestParam(%s) failed: %v`, bindParam, err)
+		}
+	}
+
+	for _, bindParam := range []string{"caller", "caller=user", "trace=header:", "1st=now", "a-b=now"} {
+		_, err := parseRequestParam(bindParam)
+		if err == nil {
+			t.Fatalf(`parseRequestParam(%s) should fail`, bindParam)
+		}
+	}
+}
+
+func TestRequestParams(t *testing.T) {
+	params := []requestParam{}
+	for _, bindParam := range []string{"caller=identity", "ip=client_ip", "at=now", "at_unix=now_unix", "trace=header:x-trace-id", "missing=header:X-Missing"} {
+		param, err := parseRequestParam(bindParam)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params = append(params, param)
+	}
+
+	req := httptest.NewRequest("GET", "http://example.org/query", nil)
+	req.RemoteAddr = "192.0.2.7:51234"
+	req.Header.Set("X-Trace-Id", "abc")
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	expected := []sql.NamedArg{
+		sql.Named("caller", "billing"),
+		sql.Named("ip", "192.0.2.7"),
+		sql.Named("at", "2020-01-02 03:04:05"),
+		sql.Named("at_unix", now.Unix()),
+		sql.Named("trace", "abc"),
+		sql.Named("missing", nil),
+	}
+	boundParams := requestParams(params, req, "billing", "192.0.2.7", now)
+	for i := range expected {
+		if boundParams[i] != expected[i] {
+			t.Fatalf(`requestParams()[%d] (%#v) != %#v`, i, boundParams[i], expected[i])
+		}
+	}
+
+	boundParams = requestParams(params[:1], req, "", "192.0.2.7", now)
+	if boundParams[0].Value != nil {
+		t.Fatalf(`identity param (%#v) should be NULL without an identity`, boundParams[0].Value)
+	}
+}
+
+func TestRequestParamsAuditInsert(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "boundparams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbPath := copyTestDb(t, tmpDir)
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("CREATE TABLE audit (dns TEXT, client_ip TEXT, at TEXT, trace TEXT)")
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryHandler, err := initQueryHandler(dbPath, "INSERT INTO audit VALUES (?, :client_ip, :now, :trace)", 0,
+		withRequestParams([]string{"client_ip=client_ip", "now=now", "trace=header:X-Trace-Id"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "http://example.org/query", strings.NewReader("github.com\nexample.org"))
+	req.RemoteAddr = "192.0.2.7:51234"
+	req.Header.Set("X-Trace-Id", "abc")
+	w := httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d): %s`, resp.StatusCode, http.StatusOK, body)
+	}
+
+	// The client can't set a bound param
+	req = httptest.NewRequest("POST", "http://example.org/query", strings.NewReader("github.com,10.0.0.1"))
+	w = httptest.NewRecorder()
+	queryHandler(w, req)
+	if w.Result().StatusCode == http.StatusOK {
+		t.Fatal(`a request line with a bound param should fail`)
+	}
+
+	selectHandler, err := initQueryHandler(dbPath, "SELECT dns, client_ip, trace, at = datetime(at) FROM audit ORDER BY rowid", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	selectHandler(w, httptest.NewRequest("GET", "http://example.org/query", nil))
+
+	var fullResponse []queryResult
+	err = json.NewDecoder(w.Result().Body).Decode(&fullResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedResponse := []queryResult{
+		{
+			Out: [][]interface{}{
+				{"github.com", "192.0.2.7", "abc", float64(1)},
+				{"example.org", "192.0.2.7", "abc", float64(1)},
+			}},
+	}
+	compare(t, fullResponse, expectedResponse)
+}
+
+func TestRequestParamsBoundTwice(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "boundparams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	secretPath := filepath.Join(tmpDir, "secret")
+	err = ioutil.WriteFile(secretPath, []byte("s3cr3t"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = :caller", 0,
+		withJWT(jwtSettings{secretPath: secretPath, claimParams: []string{"caller=sub"}}),
+		withRequestParams([]string{"caller=identity"}))
+	if err == nil {
+		t.Fatal(`binding a param both from a JWT claim and from the request should fail`)
+	}
+
+	_, err = initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = :caller", 0,
+		withRequestParams([]string{"caller=identity", "caller=client_ip"}))
+	if err == nil {
+		t.Fatal(`binding a param twice should fail`)
+	}
+}
+
+func TestQueryParamLayout(t *testing.T) {
+	for queryString, expected := range map[string][]string{
+		"SELECT * FROM t WHERE a = ?":                                      {""},
+		"SELECT * FROM t WHERE a = :x AND b = ? AND c = :x AND d = ?":      {"x", "", ""},
+		"SELECT * FROM t WHERE a = ?2 AND b = @y AND c = ?1":               {"", "", "y"},
+		"SELECT * FROM t WHERE a = $z AND b = ?3":                          {"z", "", ""},
+		"SELECT 'a = ?', [b:c], a$b FROM t -- ?\nWHERE a = ? /* :block */": {""},
+		"SELECT * FROM t": nil,
+	} {
+		layout := queryParamLayout(queryString)
+		if len(layout) != len(expected) {
+			t.Fatalf(`queryParamLayout(%q) (%q) != %q`, queryString, layout, expected)
+		}
+		for i := range layout {
+			if layout[i] != expected[i] {
+				t.Fatalf(`queryParamLayout(%q) (%q) != %q`, queryString, layout, expected)
+			}
+		}
+	}
+}
+
+func TestRequestParamsBeforePositional(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "boundparams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbPath := copyTestDb(t, tmpDir)
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("CREATE TABLE audit (client_ip TEXT, dns TEXT)")
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		query string
+		body  string
+		rows  int
+	}{
+		{"SELECT * FROM ip_dns WHERE :client_ip = '192.0.2.7' AND dns = ?", "github.com", 2},
+		{"INSERT INTO audit VALUES (:client_ip, ?)", "github.com", 0},
+		{"SELECT * FROM audit WHERE client_ip = :client_ip AND dns = ?", "github.com", 1},
+	} {
+		queryHandler, err := initQueryHandler(dbPath, test.query, 0,
+			withRequestParams([]string{"client_ip=client_ip"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("POST", "http://example.org/query", strings.NewReader(test.body))
+		req.RemoteAddr = "192.0.2.7:51234"
+		w := httptest.NewRecorder()
+		queryHandler(w, req)
+
+		resp := w.Result()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(resp.Body)
+			t.Fatalf(`%s: resp.StatusCode (%d) != http.StatusOK (%d): %s`, test.query, resp.StatusCode, http.StatusOK, body)
+		}
+
+		var fullResponse []queryResult
+		err = json.NewDecoder(resp.Body).Decode(&fullResponse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fullResponse) != 1 || len(fullResponse[0].Out) != test.rows {
+			t.Fatalf(`%s: fullResponse (%v) should have %d rows`, test.query, fullResponse, test.rows)
+		}
+	}
+}
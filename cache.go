@@ -0,0 +1,264 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	json "github.com/json-iterator/go"
+)
+
+// resultCache is an LRU cache of query results, keyed by the query and its params.
+// It is bounded by the estimated memory size of the cached results,
+// and it is purged whenever the database version changes.
+type resultCache struct {
+	maxBytes int64
+	ttl      time.Duration
+
+	mutex   sync.Mutex
+	lru     *list.List // Front is the most recently used
+	entries map[string]*list.Element
+	bytes   int64
+	version string // The database version of the cached results
+
+	hits          uint64
+	misses        uint64
+	evictions     uint64
+	invalidations uint64
+}
+
+type cacheEntry struct {
+	key       string
+	result    queryResult
+	bytes     int64
+	expiresAt time.Time // Zero if it never expires
+}
+
+// cacheStats are reported in "/stats"
+type cacheStats struct {
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Entries       int    `json:"entries"`
+	Bytes         int64  `json:"bytes"`
+	MaxBytes      int64  `json:"max_bytes"`
+	Evictions     uint64 `json:"evictions"`
+	Invalidations uint64 `json:"invalidations"`
+}
+
+func newResultCache(maxBytes int64, ttl time.Duration) *resultCache {
+	return &resultCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+func (cache *resultCache) get(version string, key string) (queryResult, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.checkVersion(version)
+
+	if element, ok := cache.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		if entry.expiresAt.IsZero() || time.Now().Before(entry.expiresAt) {
+			cache.lru.MoveToFront(element)
+			cache.hits++
+			return entry.result, true
+		}
+
+		// Expired
+		cache.remove(element)
+	}
+
+	cache.misses++
+	return queryResult{}, false
+}
+
+func (cache *resultCache) set(version string, key string, result queryResult) {
+	entry := &cacheEntry{
+		key:    key,
+		result: result,
+		bytes:  int64(len(key)) + estimateSize(result),
+	}
+	if cache.ttl > 0 {
+		entry.expiresAt = time.Now().Add(cache.ttl)
+	}
+
+	if entry.bytes > cache.maxBytes {
+		// Would evict everything and still not fit
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.checkVersion(version)
+
+	if element, ok := cache.entries[key]; ok {
+		cache.remove(element)
+	}
+
+	cache.entries[key] = cache.lru.PushFront(entry)
+	cache.bytes += entry.bytes
+
+	for cache.bytes > cache.maxBytes {
+		cache.remove(cache.lru.Back())
+		cache.evictions++
+	}
+}
+
+// checkVersion purges the cache if the database version changed.
+// cache.mutex must be held.
+func (cache *resultCache) checkVersion(version string) {
+	if version == cache.version {
+		return
+	}
+
+	if cache.version != "" {
+		cache.invalidations++
+	}
+
+	cache.version = version
+	cache.lru.Init()
+	cache.entries = map[string]*list.Element{}
+	cache.bytes = 0
+}
+
+// remove removes element from the cache.
+// cache.mutex must be held.
+func (cache *resultCache) remove(element *list.Element) {
+	entry := cache.lru.Remove(element).(*cacheEntry)
+	delete(cache.entries, entry.key)
+	cache.bytes -= entry.bytes
+}
+
+func (cache *resultCache) stats() cacheStats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return cacheStats{
+		Hits:          cache.hits,
+		Misses:        cache.misses,
+		Entries:       len(cache.entries),
+		Bytes:         cache.bytes,
+		MaxBytes:      cache.maxBytes,
+		Evictions:     cache.evictions,
+		Invalidations: cache.invalidations,
+	}
+}
+
+// resultKey identifies the result of query with queryParams,
+// for caching it and for coalescing identical executions
+func resultKey(query *preparedQuery, queryParams []interface{}, maxRows int) (string, error) {
+	paramsJSON, err := json.Marshal(queryParams)
+	if err != nil {
+		return "", err
+	}
+
+	return query.queryString + "\x00" + strconv.Itoa(maxRows) + "\x00" + string(paramsJSON), nil
+}
+
+// estimateSize estimates the memory size of result in bytes
+func estimateSize(result queryResult) int64 {
+	// Rough overhead of a slice header or an interface{}
+	const overhead = 16
+
+	size := int64(overhead * 3)
+	for _, header := range result.Headers {
+		size += overhead + int64(len(header))
+	}
+	for _, row := range result.Out {
+		size += overhead
+		for _, cell := range row {
+			size += overhead
+			switch v := cell.(type) {
+			case string:
+				size += int64(len(v))
+			case []byte:
+				size += int64(len(v))
+			default:
+				size += 8
+			}
+		}
+	}
+
+	return size
+}
+
+// dataVersion returns the current version of the database.
+// It changes whenever the database is modified, either by another connection
+// (PRAGMA data_version) or by this one (total_changes()).
+func dataVersion(ctx context.Context, db *sql.DB) (string, error) {
+	var dataVersion, totalChanges int64
+	err := db.QueryRowContext(ctx, "SELECT data_version, total_changes() FROM pragma_data_version()").Scan(&dataVersion, &totalChanges)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d:%d", dataVersion, totalChanges), nil
+}
+
+var writeKeywordsRegex = regexp.MustCompile(`(?i)\b(INSERT|UPDATE|DELETE|REPLACE|CREATE|DROP|ALTER|ATTACH|DETACH|PRAGMA|VACUUM|REINDEX|ANALYZE)\b`)
+
+// isReadOnlyQuery is a conservative check that queryString doesn't modify the database,
+// so executing it can be skipped in favor of a cached result
+func isReadOnlyQuery(queryString string) bool {
+	fields := strings.Fields(queryString)
+	if len(fields) == 0 {
+		return false
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "SELECT", "VALUES", "WITH":
+		return !writeKeywordsRegex.MatchString(queryString)
+	}
+	return false
+}
+
+// computeETag returns the ETag of a GET response, which changes with the query,
+// the URL query string params, the bound params, the redaction rules or the database version
+func computeETag(queryString string, urlQuery url.Values, boundParams []sql.NamedArg, redaction string, version string) string {
+	hash := sha256.New()
+	hash.Write([]byte(queryString))
+	hash.Write([]byte{0})
+	hash.Write([]byte(urlQuery.Encode())) // Encode() sorts by key
+	hash.Write([]byte{0})
+	for _, param := range boundParams {
+		fmt.Fprintf(hash, "%s=%#v\x00", param.Name, param.Value)
+	}
+	hash.Write([]byte(redaction))
+	hash.Write([]byte{0})
+	hash.Write([]byte(version))
+
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+// etagMatches reports whether the If-None-Match header matches etag
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func setCachingHeaders(w http.ResponseWriter, etag string, cacheControl string) {
+	w.Header().Set("ETag", etag)
+	if cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+}
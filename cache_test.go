@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	json "github.com/json-iterator/go"
+)
+
+func getStats(t *testing.T, queryHandler func(w http.ResponseWriter, r *http.Request)) stats {
+	req := httptest.NewRequest("GET", "http://example.org/stats", nil)
+	w := httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+	}
+
+	var response stats
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestCacheHitsAndMisses(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withCache(1<<20, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST",
+			"http://example.org/query",
+			strings.NewReader("github.com\none.one.one.one\ngithub.com"))
+		w := httptest.NewRecorder()
+		queryHandler(w, req)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+		}
+
+		var fullResponse []queryResult
+		err = json.NewDecoder(resp.Body).Decode(&fullResponse)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedResponse := []queryResult{
+			{
+				Out: [][]interface{}{
+					{"192.30.253.112", "github.com"},
+					{"192.30.253.113", "github.com"},
+				}},
+			{
+				Out: [][]interface{}{
+					{"1.1.1.1", "one.one.one.one"},
+				}},
+			{
+				Out: [][]interface{}{
+					{"192.30.253.112", "github.com"},
+					{"192.30.253.113", "github.com"},
+				}},
+		}
+
+		compare(t, fullResponse, expectedResponse)
+	}
+
+	cacheStats := getStats(t, queryHandler).Cache
+	if cacheStats == nil {
+		t.Fatal(`Stats should have cache stats`)
+	}
+	if cacheStats.Misses != 2 {
+		t.Fatalf(`cacheStats.Misses (%d) != 2`, cacheStats.Misses)
+	}
+	if cacheStats.Hits != 4 {
+		t.Fatalf(`cacheStats.Hits (%d) != 4`, cacheStats.Hits)
+	}
+	if cacheStats.Entries != 2 {
+		t.Fatalf(`cacheStats.Entries (%d) != 2`, cacheStats.Entries)
+	}
+}
+
+func TestCacheDisabledForWrites(t *testing.T) {
+	for _, test := range []struct {
+		queryString string
+		readOnly    bool
+	}{
+		{"SELECT * FROM ip_dns", true},
+		{"  with x AS (SELECT 1) SELECT * FROM x", true},
+		{"WITH x AS (SELECT 1) INSERT INTO ip_dns SELECT * FROM x", false},
+		{"INSERT INTO ip_dns VALUES (?, ?)", false},
+		{"DELETE FROM ip_dns", false},
+	} {
+		if isReadOnlyQuery(test.queryString) != test.readOnly {
+			t.Fatalf(`isReadOnlyQuery("%s") != %v`, test.queryString, test.readOnly)
+		}
+	}
+}
+
+func TestCacheEvictionAndExpiry(t *testing.T) {
+	query := &preparedQuery{queryString: "SELECT ?"}
+	result := queryResult{Headers: []string{"x"}, Out: [][]interface{}{{"aaaaaaaaaa"}}}
+
+	key1, _ := resultKey(query, []interface{}{"1"}, 0)
+	key2, _ := resultKey(query, []interface{}{"2"}, 0)
+
+	entryBytes := int64(len(key1)) + estimateSize(result)
+	cache := newResultCache(entryBytes+entryBytes/2, 0)
+
+	cache.set("1:0", key1, result)
+	cache.set("1:0", key2, result)
+
+	if _, ok := cache.get("1:0", key1); ok {
+		t.Fatal(`key1 should have been evicted`)
+	}
+	if _, ok := cache.get("1:0", key2); !ok {
+		t.Fatal(`key2 should be cached`)
+	}
+	if _, ok := cache.get("2:0", key2); ok {
+		t.Fatal(`A new database version should purge the cache`)
+	}
+	if cache.stats().Evictions != 1 || cache.stats().Invalidations != 1 {
+		t.Fatalf(`Unexpected stats %+v`, cache.stats())
+	}
+
+	cache = newResultCache(1<<20, time.Millisecond)
+	cache.set("1:0", key1, result)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := cache.get("1:0", key1); ok {
+		t.Fatal(`key1 should have expired`)
+	}
+}
+
+func TestETag(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withCacheControl("max-age=10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(url string, ifNoneMatch string) *http.Response {
+		req := httptest.NewRequest("GET", url, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		queryHandler(w, req)
+		return w.Result()
+	}
+
+	resp := get("http://example.org/query?p=github.com", "")
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal(`ETag header should be set`)
+	}
+	if resp.Header.Get("Cache-Control") != "max-age=10" {
+		t.Fatalf(`resp.Header.Get("Cache-Control") (%s) != "max-age=10"`, resp.Header.Get("Cache-Control"))
+	}
+
+	resp = get("http://example.org/query?p=github.com", `"banana", `+etag)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusNotModified (%d)`, resp.StatusCode, http.StatusNotModified)
+	}
+	if resp.Header.Get("ETag") != etag {
+		t.Fatalf(`resp.Header.Get("ETag") (%s) != %s`, resp.Header.Get("ETag"), etag)
+	}
+
+	resp = get("http://example.org/query?p=one.one.one.one", etag)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+	}
+	if resp.Header.Get("ETag") == etag {
+		t.Fatal(`Different params should have a different ETag`)
+	}
+
+	// POST responses aren't cacheable
+	req := httptest.NewRequest("POST", "http://example.org/query", strings.NewReader("github.com"))
+	w := httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp = w.Result()
+	defer resp.Body.Close()
+
+	if resp.Header.Get("ETag") != "" {
+		t.Fatal(`POST responses shouldn't have an ETag`)
+	}
+}
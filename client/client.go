@@ -0,0 +1,135 @@
+// Package client signs requests to SQLiteQueryServer with HMAC-SHA256,
+// for callers that can't use client certificates.
+//
+// A signed request has the headers:
+//
+//	X-Signature-Key-Id: <key id in the server's keyring>
+//	X-Signature-Timestamp: <Unix seconds>
+//	X-Signature-Nonce: <random string, unique per request>
+//	X-Signature: <hex HMAC-SHA256 of StringToSign() with the key's secret>
+//
+// Usage:
+//
+//	httpClient := &http.Client{Transport: &client.Transport{Signer: client.Signer{KeyID: "billing", Secret: secret}}}
+//	resp, err := httpClient.Post("https://sqs.internal/query", "text/csv", strings.NewReader("github.com"))
+package client
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The headers of a signed request
+const (
+	KeyIDHeader     = "X-Signature-Key-Id"
+	TimestampHeader = "X-Signature-Timestamp"
+	NonceHeader     = "X-Signature-Nonce"
+	SignatureHeader = "X-Signature"
+)
+
+// StringToSign returns the string that is signed for a request: its method, its path
+// (with its query string), its timestamp (Unix seconds), its nonce and the hex SHA256 of its body
+func StringToSign(method string, requestURI string, timestamp string, nonce string, bodyHash string) string {
+	return method + "\n" + requestURI + "\n" + timestamp + "\n" + nonce + "\n" + bodyHash
+}
+
+// Nonce returns a random nonce, so identical requests signed in the same second
+// have different signatures and aren't taken for replays
+func Nonce() (string, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", fmt.Errorf("Cannot generate nonce: %v", err)
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// BodyHash returns the hex SHA256 of a request body
+func BodyHash(body []byte) string {
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:])
+}
+
+// Signature returns the hex HMAC-SHA256 of stringToSign with secret
+func Signature(secret []byte, stringToSign string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(stringToSign))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Signer signs requests with a key of the server's keyring
+type Signer struct {
+	KeyID  string
+	Secret []byte
+
+	// Now returns the time to sign requests at, time.Now if nil
+	Now func() time.Time
+}
+
+// Sign sets the signature headers of req.
+// It reads req's body to hash it, and replaces it with an in-memory copy.
+func (signer *Signer) Sign(req *http.Request) error {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return fmt.Errorf("Cannot read request body: %v", err)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+		req.ContentLength = int64(len(body))
+	}
+
+	now := time.Now
+	if signer.Now != nil {
+		now = signer.Now
+	}
+	timestamp := strconv.FormatInt(now().Unix(), 10)
+	nonce, err := Nonce()
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(KeyIDHeader, signer.KeyID)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set(SignatureHeader, Signature(signer.Secret, StringToSign(req.Method, req.URL.RequestURI(), timestamp, nonce, BodyHash(body))))
+	return nil
+}
+
+// Transport is a http.RoundTripper that signs every request with Signer
+type Transport struct {
+	Signer Signer
+
+	// Base sends the signed requests, http.DefaultTransport if nil
+	Base http.RoundTripper
+}
+
+// RoundTrip signs a copy of req and sends it
+func (transport *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request
+	signed := req.Clone(req.Context())
+	err := transport.Signer.Sign(signed)
+	if err != nil {
+		return nil, err
+	}
+
+	base := transport.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(signed)
+}
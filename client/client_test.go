@@ -0,0 +1,73 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStringToSign(t *testing.T) {
+	// echo -n "" | sha256sum
+	if BodyHash(nil) != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Fatalf(`BodyHash(nil) (%s) should be the SHA256 of an empty body`, BodyHash(nil))
+	}
+
+	stringToSign := StringToSign("POST", "/query?x=1", "1577934245", "n0nce", BodyHash([]byte("github.com")))
+	if stringToSign != "POST\n/query?x=1\n1577934245\nn0nce\n"+BodyHash([]byte("github.com")) {
+		t.Fatalf(`StringToSign() (%q) is wrong`, stringToSign)
+	}
+
+	// echo -n "a" | openssl dgst -sha256 -hmac "key"
+	if Signature([]byte("key"), "a") != "780c3db4ce3de5b9e55816fba98f590631d96c075271b26976238d5f4444219b" {
+		t.Fatalf(`Signature() (%s) is wrong`, Signature([]byte("key"), "a"))
+	}
+}
+
+func TestTransport(t *testing.T) {
+	secret := []byte("s3cr3t")
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "github.com" {
+			t.Errorf(`body (%s) != github.com`, body)
+		}
+		if r.Header.Get(KeyIDHeader) != "billing" {
+			t.Errorf(`%s (%s) != billing`, KeyIDHeader, r.Header.Get(KeyIDHeader))
+		}
+		if r.Header.Get(TimestampHeader) != strconv.FormatInt(now.Unix(), 10) {
+			t.Errorf(`%s (%s) != %d`, TimestampHeader, r.Header.Get(TimestampHeader), now.Unix())
+		}
+		if r.Header.Get(NonceHeader) == "" {
+			t.Errorf(`%s should be set`, NonceHeader)
+		}
+		expected := Signature(secret, StringToSign(r.Method, r.URL.RequestURI(), r.Header.Get(TimestampHeader), r.Header.Get(NonceHeader), BodyHash(body)))
+		if r.Header.Get(SignatureHeader) != expected {
+			t.Errorf(`%s (%s) != %s`, SignatureHeader, r.Header.Get(SignatureHeader), expected)
+		}
+	}))
+	defer server.Close()
+
+	httpClient := &http.Client{Transport: &Transport{Signer: Signer{KeyID: "billing", Secret: secret, Now: func() time.Time { return now }}}}
+
+	req, err := http.NewRequest("POST", server.URL+"/query?x=1", strings.NewReader("github.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if req.Header.Get(SignatureHeader) != "" {
+		t.Fatalf(`Transport shouldn't modify the original request`)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// flightGroup coalesces identical concurrent executions,
+// so in-flight identical executions share one result
+type flightGroup struct {
+	mutex sync.Mutex
+	calls map[string]*flightCall
+
+	coalesced uint64 // Executions that shared the result of another execution
+}
+
+type flightCall struct {
+	done   chan struct{}
+	result queryResult
+	err    error
+}
+
+// do executes fn, unless an execution with the same key is in flight,
+// in which case it waits for that execution's result.
+// shared is true if the result is of another execution.
+func (group *flightGroup) do(ctx context.Context, key string, fn func() (queryResult, error)) (result queryResult, shared bool, err error) {
+	group.mutex.Lock()
+	if group.calls == nil {
+		group.calls = map[string]*flightCall{}
+	}
+
+	if call, ok := group.calls[key]; ok {
+		group.mutex.Unlock()
+		atomic.AddUint64(&group.coalesced, 1)
+
+		select {
+		case <-call.done:
+			return call.result, true, call.err
+		case <-ctx.Done():
+			return queryResult{}, true, ctx.Err()
+		}
+	}
+
+	call := &flightCall{done: make(chan struct{})}
+	group.calls[key] = call
+	group.mutex.Unlock()
+
+	call.result, call.err = fn()
+
+	group.mutex.Lock()
+	delete(group.calls, key)
+	group.mutex.Unlock()
+	close(call.done)
+
+	return call.result, false, call.err
+}
+
+func (group *flightGroup) coalescedCount() uint64 {
+	return atomic.LoadUint64(&group.coalesced)
+}
+
+// runQuery executes query with queryParams, like runQuery(),
+// but read-only queries results are served from the cache when possible,
+// and identical concurrent executions of read-only queries are coalesced.
+// dbVersion is the current database version, see dataVersion().
+func (server *queryServer) runQuery(ctx context.Context, dbVersion string, query *preparedQuery, csvRecord []string, queryParams []interface{}, maxRows int) (queryResult, error) {
+	if !query.readOnly {
+		return runQuery(ctx, query.queryStmt, csvRecord, queryParams, maxRows)
+	}
+
+	key, err := resultKey(query, queryParams, maxRows)
+	if err != nil {
+		return runQuery(ctx, query.queryStmt, csvRecord, queryParams, maxRows)
+	}
+
+	if server.cache != nil {
+		if result, ok := server.cache.get(dbVersion, key); ok {
+			result.In = csvRecord
+			return result, nil
+		}
+	}
+
+	execute := func() (queryResult, error) {
+		result, err := runQuery(ctx, query.queryStmt, csvRecord, queryParams, maxRows)
+		if err == nil && server.cache != nil {
+			server.cache.set(dbVersion, key, result)
+		}
+		return result, err
+	}
+
+	result, shared, err := server.flights.do(ctx, key, execute)
+	if shared && err != nil && ctx.Err() == nil {
+		// The shared execution may have failed because of its own request
+		// (e.g. its client disconnected or timed out), so execute it for this request
+		result, err = execute()
+	}
+
+	result.In = csvRecord
+	return result, err
+}
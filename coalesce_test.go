@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupCoalesces(t *testing.T) {
+	var group flightGroup
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	executions := 0
+
+	leaderDone := make(chan queryResult)
+	go func() {
+		result, _, _ := group.do(context.Background(), "key", func() (queryResult, error) {
+			executions++
+			close(started)
+			<-release
+			return queryResult{Headers: []string{"x"}}, nil
+		})
+		leaderDone <- result
+	}()
+	<-started
+
+	followerDone := make(chan bool)
+	go func() {
+		result, shared, err := group.do(context.Background(), "key", func() (queryResult, error) {
+			executions++
+			return queryResult{}, nil
+		})
+		followerDone <- err == nil && shared && len(result.Headers) == 1
+	}()
+
+	for group.coalescedCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	<-leaderDone
+	if !<-followerDone {
+		t.Fatal(`Follower should get the leader's result`)
+	}
+	if executions != 1 {
+		t.Fatalf(`executions (%d) != 1`, executions)
+	}
+}
+
+func TestFlightGroupFollowerContext(t *testing.T) {
+	var group flightGroup
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	go group.do(context.Background(), "key", func() (queryResult, error) {
+		close(started)
+		<-release
+		return queryResult{}, nil
+	})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, shared, err := group.do(ctx, "key", func() (queryResult, error) {
+		return queryResult{}, nil
+	})
+	if !shared {
+		t.Fatal(`Should wait for the in-flight execution`)
+	}
+	if err != context.DeadlineExceeded {
+		t.Fatalf(`err (%v) != context.DeadlineExceeded`, err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported compression formats of the database file, by its extension
+const (
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// compressionFormat returns the compression format of the database file at dbPath
+// by its extension, or "" if it isn't compressed
+func compressionFormat(dbPath string) string {
+	switch {
+	case strings.HasSuffix(dbPath, ".gz"):
+		return compressionGzip
+	case strings.HasSuffix(dbPath, ".zst"):
+		return compressionZstd
+	}
+	return ""
+}
+
+// checkDatabaseFile makes sure that the database file at dbPath exists,
+// and that its content matches its format
+func checkDatabaseFile(dbPath string) error {
+	file, err := os.Open(dbPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("Database file '%s' doesn't exist", dbPath)
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header := make([]byte, len(sqliteHeader))
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	header = header[:n]
+
+	switch compressionFormat(dbPath) {
+	case compressionGzip:
+		if !bytes.HasPrefix(header, gzipMagic) {
+			return fmt.Errorf("Database file '%s' isn't a gzip file", dbPath)
+		}
+	case compressionZstd:
+		if !bytes.HasPrefix(header, zstdMagic) {
+			return fmt.Errorf("Database file '%s' isn't a zstd file", dbPath)
+		}
+	default:
+		// SQLite treats an empty file as an empty database
+		if n > 0 && !bytes.Equal(header, sqliteHeader) {
+			return fmt.Errorf("Database file '%s' isn't a SQLite database", dbPath)
+		}
+	}
+
+	return nil
+}
+
+// decompressDatabase decompresses the database file at dbPath into a temp file,
+// and returns its path. The compressed stream's checksum is verified while decompressing,
+// and then the decompressed database is verified with "PRAGMA quick_check".
+func decompressDatabase(dbPath string) (string, error) {
+	start := time.Now()
+
+	src, err := os.Open(dbPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	var reader io.Reader
+	switch compressionFormat(dbPath) {
+	case compressionGzip:
+		gzipReader, err := gzip.NewReader(src)
+		if err != nil {
+			return "", fmt.Errorf("Cannot decompress database file '%s': %v", dbPath, err)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	case compressionZstd:
+		zstdReader, err := zstd.NewReader(src)
+		if err != nil {
+			return "", fmt.Errorf("Cannot decompress database file '%s': %v", dbPath, err)
+		}
+		defer zstdReader.Close()
+		reader = zstdReader
+	default:
+		return "", fmt.Errorf("Database file '%s' isn't compressed", dbPath)
+	}
+
+	dest, err := ioutil.TempFile("", "sqlitequeryserver-*.db")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(dest, reader)
+	if closeErr := dest.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		removeDatabaseFile(dest.Name())
+		return "", fmt.Errorf("Cannot decompress database file '%s': %v", dbPath, err)
+	}
+
+	err = verifyDatabase(dest.Name())
+	if err != nil {
+		removeDatabaseFile(dest.Name())
+		return "", fmt.Errorf("Decompressed database file '%s' is corrupt: %v", dbPath, err)
+	}
+
+	log.Printf("Decompressed database file '%s' into '%s' in %v\n", dbPath, dest.Name(), time.Since(start))
+
+	return dest.Name(), nil
+}
+
+// verifyDatabase checks the integrity of the database file at dbPath
+func verifyDatabase(dbPath string) error {
+	err := checkDatabaseFile(dbPath)
+	if err != nil {
+		return err
+	}
+
+	dsn, _ := databaseDSN(dbPath, openModeImmutable)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	err = db.QueryRow("PRAGMA quick_check").Scan(&result)
+	if err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("%s", result)
+	}
+
+	return nil
+}
+
+// removeDatabaseFile removes the database file at dbPath, along with its WAL files
+func removeDatabaseFile(dbPath string) {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(dbPath + suffix)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	json "github.com/json-iterator/go"
+	"github.com/klauspost/compress/zstd"
+)
+
+func compressTestDb(t *testing.T, dir string, format string) string {
+	content, err := ioutil.ReadFile(testDbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var compressed bytes.Buffer
+	var writer io.WriteCloser
+	var dbPath string
+	switch format {
+	case compressionGzip:
+		writer = gzip.NewWriter(&compressed)
+		dbPath = filepath.Join(dir, "ip_dns.db.gz")
+	case compressionZstd:
+		writer, err = zstd.NewWriter(&compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbPath = filepath.Join(dir, "ip_dns.db.zst")
+	}
+
+	_, err = writer.Write(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(dbPath, compressed.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dbPath
+}
+
+func TestCompressedDb(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "compressed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, format := range []string{compressionGzip, compressionZstd} {
+		dbPath := compressTestDb(t, tmpDir, format)
+
+		for _, opts := range [][]handlerOption{nil, {withInMemory()}} {
+			queryHandler, err := initQueryHandler(dbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("POST", "http://example.org/query", strings.NewReader("one.one.one.one"))
+			w := httptest.NewRecorder()
+			queryHandler(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+			}
+
+			var fullResponse []queryResult
+			err = json.NewDecoder(resp.Body).Decode(&fullResponse)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedResponse := []queryResult{
+				{
+					Out: [][]interface{}{
+						{"1.1.1.1", "one.one.one.one"},
+					}},
+			}
+
+			compare(t, fullResponse, expectedResponse)
+		}
+	}
+}
+
+func TestCompressedDbReadOnly(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "compressed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbPath := compressTestDb(t, tmpDir, compressionGzip)
+
+	// The decompressed temp file is opened immutable, even with the default --open-mode=rw
+	queryHandler, err := initQueryHandler(dbPath, "INSERT INTO ip_dns VALUES (?, ?)", 0, withOpenMode(openModeReadWrite))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "http://example.org/query", strings.NewReader("93.184.216.34,example.org"))
+	w := httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusInternalServerError (%d)`, resp.StatusCode, http.StatusInternalServerError)
+	}
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(respBytes), "readonly") {
+		t.Fatalf(`A write should fail with a readonly database error: %s`, respBytes)
+	}
+}
+
+func TestBadCompressedDb(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "compressed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	gzPath := compressTestDb(t, tmpDir, compressionGzip)
+	gzContent, err := ioutil.ReadFile(gzPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstPath := compressTestDb(t, tmpDir, compressionZstd)
+	zstContent, err := ioutil.ReadFile(zstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		content []byte
+		err     string
+	}{
+		{"zst_as_gz.db.gz", zstContent, "isn't a gzip file"},
+		{"gz_as_zst.db.zst", gzContent, "isn't a zstd file"},
+		{"gz_as_db.db", gzContent, "isn't a SQLite database"},
+		{"truncated.db.gz", gzContent[:len(gzContent)/2], "Cannot decompress"},
+		{"truncated.db.zst", zstContent[:len(zstContent)/2], "Cannot decompress"},
+	} {
+		dbPath := filepath.Join(tmpDir, test.name)
+		err = ioutil.WriteFile(dbPath, test.content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = initQueryHandler(dbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0)
+		if err == nil {
+			t.Fatalf(`Should fail with '%s'`, test.name)
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Fatalf(`Error for '%s' should contain "%s": %v`, test.name, test.err, err)
+		}
+	}
+}
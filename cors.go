@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The CORS settings without --cors-* params
+const (
+	defaultCORSMethods       = "GET, POST"
+	defaultCORSHeaders       = "Authorization, Content-Type, If-None-Match, X-API-Key, X-Query-Timeout"
+	defaultCORSExposeHeaders = "ETag"
+)
+
+// corsSettings configures which browser origins may call the server
+type corsSettings struct {
+	origins       []string // Allowed origins, "*" for any, "https://*.example.org" for subdomains
+	methods       []string // Allowed methods of preflighted requests
+	headers       []string // Allowed request headers of preflighted requests
+	exposeHeaders []string // Response headers that browsers expose to scripts
+	credentials   bool     // Allow cookies and HTTP authentication
+	maxAge        time.Duration
+}
+
+// corsPolicy sets the CORS headers of responses and answers preflight requests
+type corsPolicy struct {
+	settings  corsSettings
+	anyOrigin bool
+	origins   map[string]bool
+	wildcards []string // Suffixes of subdomains, e.g. ".example.org", by scheme prefix "https://"
+	schemes   []string
+}
+
+func newCORSPolicy(settings corsSettings) (*corsPolicy, error) {
+	policy := &corsPolicy{
+		settings: settings,
+		origins:  map[string]bool{},
+	}
+
+	for _, origin := range settings.origins {
+		origin = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+		switch {
+		case origin == "*":
+			policy.anyOrigin = true
+		case strings.Contains(origin, "://*."):
+			sep := strings.Index(origin, "://*.")
+			policy.schemes = append(policy.schemes, origin[:sep+len("://")])
+			policy.wildcards = append(policy.wildcards, origin[sep+len("://*"):])
+		case strings.Contains(origin, "://"):
+			policy.origins[origin] = true
+		default:
+			return nil, fmt.Errorf("Invalid CORS origin '%s', must be like 'https://example.org'", origin)
+		}
+	}
+
+	if policy.anyOrigin && settings.credentials {
+		// Any website could make requests with the user's credentials
+		return nil, fmt.Errorf("CORS credentials can't be allowed for any origin ('*'), must list the allowed origins")
+	}
+
+	return policy, nil
+}
+
+// allowsOrigin reports whether origin may call the server
+func (policy *corsPolicy) allowsOrigin(origin string) bool {
+	if policy.anyOrigin {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+	if policy.origins[origin] {
+		return true
+	}
+	for i, suffix := range policy.wildcards {
+		if strings.HasPrefix(origin, policy.schemes[i]) && strings.HasSuffix(origin, suffix) && len(origin) > len(policy.schemes[i])+len(suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// setHeaders sets the CORS headers of the response to r,
+// a request from a disallowed origin gets none so the browser blocks it
+func (policy *corsPolicy) setHeaders(w http.ResponseWriter, r *http.Request) {
+	if !policy.anyOrigin {
+		// The response depends on the request's origin
+		w.Header().Add("Vary", "Origin")
+	}
+
+	origin := r.Header.Get("Origin")
+	if !policy.anyOrigin && (origin == "" || !policy.allowsOrigin(origin)) {
+		return
+	}
+
+	if policy.anyOrigin {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if policy.settings.credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(policy.settings.exposeHeaders) > 0 {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.settings.exposeHeaders, ", "))
+	}
+}
+
+// isPreflight reports whether r is a CORS preflight request
+func isPreflight(r *http.Request) bool {
+	return r.Method == "OPTIONS" && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// preflight answers the CORS preflight request r
+func (policy *corsPolicy) preflight(w http.ResponseWriter, r *http.Request, helpMessage string) {
+	origin := r.Header.Get("Origin")
+	if !policy.allowsOrigin(origin) {
+		http.Error(w, fmt.Sprintf("\n\nOrigin '%s' isn't allowed\n\n%s", origin, helpMessage), http.StatusForbidden)
+		return
+	}
+
+	method := r.Header.Get("Access-Control-Request-Method")
+	if !containsFold(policy.settings.methods, method) {
+		http.Error(w, fmt.Sprintf("\n\nMethod '%s' isn't allowed for origin '%s'\n\n%s", method, origin, helpMessage), http.StatusForbidden)
+		return
+	}
+
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(policy.settings.methods, ", "))
+	if len(policy.settings.headers) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.settings.headers, ", "))
+	}
+	if policy.settings.maxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policy.settings.maxAge/time.Second)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(list string) []string {
+	var split []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			split = append(split, item)
+		}
+	}
+	return split
+}
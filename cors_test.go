@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCORSAnyOrigin(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://example.org/query?p=github.com", nil)
+	req.Header.Set("Origin", "https://anything.example.com")
+	w := httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+	}
+	if resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf(`Access-Control-Allow-Origin (%s) != *`, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+	if resp.Header.Get("Access-Control-Allow-Credentials") != "" {
+		t.Fatal(`Access-Control-Allow-Credentials should be missing for any origin`)
+	}
+}
+
+func TestCORSAllowlist(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withCORS(corsSettings{
+		origins:       []string{"https://dashboard.example.org", "https://*.internal.example.org"},
+		methods:       []string{"GET", "POST"},
+		headers:       []string{"Content-Type", "X-Query-Timeout"},
+		exposeHeaders: []string{"ETag"},
+		credentials:   true,
+		maxAge:        10 * time.Minute,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://dashboard.example.org", true},
+		{"https://grafana.internal.example.org", true},
+		{"http://dashboard.example.org", false},
+		{"https://evil.example.com", false},
+		{"https://internal.example.org", false},
+		{"", false},
+	} {
+		req := httptest.NewRequest("GET", "http://example.org/query?p=github.com", nil)
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		w := httptest.NewRecorder()
+		queryHandler(w, req)
+
+		resp := w.Result()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf(`%s: resp.StatusCode (%d) != http.StatusOK (%d)`, test.origin, resp.StatusCode, http.StatusOK)
+		}
+		if resp.Header.Get("Vary") != "Origin" {
+			t.Fatalf(`%s: Vary (%s) != Origin`, test.origin, resp.Header.Get("Vary"))
+		}
+
+		allowOrigin := resp.Header.Get("Access-Control-Allow-Origin")
+		if test.allowed && (allowOrigin != test.origin || resp.Header.Get("Access-Control-Allow-Credentials") != "true" || resp.Header.Get("Access-Control-Expose-Headers") != "ETag") {
+			t.Fatalf(`%s: response should allow the origin with credentials, got headers %v`, test.origin, resp.Header)
+		}
+		if !test.allowed && allowOrigin != "" {
+			t.Fatalf(`%s: Access-Control-Allow-Origin (%s) should be missing`, test.origin, allowOrigin)
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withCORS(corsSettings{
+		origins: []string{"https://dashboard.example.org"},
+		methods: []string{"GET", "POST"},
+		headers: []string{"Content-Type", "X-Query-Timeout"},
+		maxAge:  10 * time.Minute,
+	}), withCache(1<<20, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		origin     string
+		method     string
+		statusCode int
+	}{
+		{"https://dashboard.example.org", "POST", http.StatusNoContent},
+		{"https://dashboard.example.org", "DELETE", http.StatusForbidden},
+		{"https://evil.example.com", "POST", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("OPTIONS", "http://example.org/query", nil)
+		req.Header.Set("Origin", test.origin)
+		req.Header.Set("Access-Control-Request-Method", test.method)
+		req.Header.Set("Access-Control-Request-Headers", "content-type")
+		w := httptest.NewRecorder()
+		queryHandler(w, req)
+
+		resp := w.Result()
+		if resp.StatusCode != test.statusCode {
+			t.Fatalf(`%s %s: resp.StatusCode (%d) != %d`, test.origin, test.method, resp.StatusCode, test.statusCode)
+		}
+		if resp.StatusCode != http.StatusNoContent {
+			continue
+		}
+
+		if resp.Header.Get("Access-Control-Allow-Origin") != test.origin ||
+			resp.Header.Get("Access-Control-Allow-Methods") != "GET, POST" ||
+			resp.Header.Get("Access-Control-Allow-Headers") != "Content-Type, X-Query-Timeout" ||
+			resp.Header.Get("Access-Control-Max-Age") != "600" {
+			t.Fatalf(`%s %s: wrong preflight headers %v`, test.origin, test.method, resp.Header)
+		}
+	}
+
+	// OPTIONS that isn't a preflight isn't allowed
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest("OPTIONS", "http://example.org/query", nil))
+	if w.Result().StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusMethodNotAllowed (%d)`, w.Result().StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestCORSPreflightWithoutAPIKey(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "cors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withKeyStore(filepath.Join(tmpDir, "keys.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Browsers don't send credentials with preflight requests
+	req := httptest.NewRequest("OPTIONS", "http://example.org/query", nil)
+	req.Header.Set("Origin", "https://dashboard.example.org")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	queryHandler(w, req)
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusNoContent (%d)`, w.Result().StatusCode, http.StatusNoContent)
+	}
+
+	// But the request itself must have an API key
+	req = httptest.NewRequest("POST", "http://example.org/query", strings.NewReader("github.com"))
+	req.Header.Set("Origin", "https://dashboard.example.org")
+	w = httptest.NewRecorder()
+	queryHandler(w, req)
+	if w.Result().StatusCode != http.StatusUnauthorized {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusUnauthorized (%d)`, w.Result().StatusCode, http.StatusUnauthorized)
+	}
+	if w.Result().Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatal(`a rejected response should have CORS headers, so the browser can read the error`)
+	}
+}
+
+func TestCORSCredentialsWithAnyOrigin(t *testing.T) {
+	_, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withCORS(corsSettings{
+		origins:     []string{"*"},
+		credentials: true,
+	}))
+	if err == nil || !strings.Contains(err.Error(), "credentials") {
+		t.Fatalf(`CORS credentials for any origin should fail, got %v`, err)
+	}
+
+	_, err = initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withCORS(corsSettings{
+		origins: []string{"dashboard.example.org"},
+	}))
+	if err == nil {
+		t.Fatal(`CORS origin without a scheme should fail`)
+	}
+}
@@ -4,5 +4,6 @@ go 1.14
 
 require (
 	github.com/json-iterator/go v1.1.9
+	github.com/klauspost/compress v1.11.13
 	github.com/mattn/go-sqlite3 v2.0.3+incompatible
 )
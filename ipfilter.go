@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ipFilter allows or denies requests by their client's IP address.
+// Behind trusted proxies the client's IP address is taken from X-Forwarded-For.
+type ipFilter struct {
+	allow          []*net.IPNet // Empty if any address is allowed
+	deny           []*net.IPNet
+	trustedProxies []*net.IPNet
+}
+
+func newIPFilter(allowCIDRs []string, denyCIDRs []string, trustedProxies []string) (*ipFilter, error) {
+	var filter ipFilter
+	var err error
+
+	filter.allow, err = parseCIDRs(allowCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	filter.deny, err = parseCIDRs(denyCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	filter.trustedProxies, err = parseCIDRs(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	return &filter, nil
+}
+
+// parseCIDRs parses CIDR ranges (e.g. "10.0.0.0/8") and single addresses,
+// each of cidrs may be a comma separated list
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, cidr := range cidrs {
+		for _, item := range splitList(cidr) {
+			if !strings.Contains(item, "/") {
+				ip := net.ParseIP(item)
+				if ip == nil {
+					return nil, fmt.Errorf("Invalid IP address '%s'", item)
+				}
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 8*net.IPv4len
+				}
+				ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+
+			_, ipNet, err := net.ParseCIDR(item)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid CIDR range '%s': %v", item, err)
+			}
+			ranges = append(ranges, ipNet)
+		}
+	}
+	return ranges, nil
+}
+
+func containsIP(ranges []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ranges {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the request's client.
+// If the request came through trusted proxies, it's the last address in X-Forwarded-For
+// that isn't a trusted proxy, because earlier addresses can be forged by the client.
+func (filter *ipFilter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(filter.trustedProxies, ip) {
+		return host
+	}
+
+	var hops []string
+	for _, forwardedFor := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, splitList(forwardedFor)...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(hops[i])
+		if hop == nil {
+			// Anything before a malformed address can't be trusted
+			break
+		}
+		ip = hop
+		if !containsIP(filter.trustedProxies, ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// allows reports whether clientIP may call the server: it's not denied and,
+// if there's an allowlist, it's allowed
+func (filter *ipFilter) allows(clientIP string) bool {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return len(filter.allow) == 0 && len(filter.deny) == 0
+	}
+	if containsIP(filter.deny, ip) {
+		return false
+	}
+	return len(filter.allow) == 0 || containsIP(filter.allow, ip)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIPFilterClientIP(t *testing.T) {
+	filter, err := newIPFilter(nil, nil, []string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		remoteAddr   string
+		forwardedFor []string
+		expectedIP   string
+		name         string
+	}{
+		{"198.51.100.7:1234", nil, "198.51.100.7", "untrusted peer without X-Forwarded-For"},
+		{"198.51.100.7:1234", []string{"203.0.113.9"}, "198.51.100.7", "X-Forwarded-For of an untrusted peer is ignored"},
+		{"10.1.2.3:1234", []string{"203.0.113.9"}, "203.0.113.9", "trusted proxy"},
+		{"10.1.2.3:1234", []string{"6.6.6.6, 203.0.113.9, 192.0.2.1"}, "203.0.113.9", "chain of trusted proxies, forged first hop"},
+		{"10.1.2.3:1234", []string{"6.6.6.6", "203.0.113.9"}, "203.0.113.9", "repeated header"},
+		{"10.1.2.3:1234", []string{"203.0.113.9, garbage, 10.4.5.6"}, "10.4.5.6", "malformed hop"},
+		{"10.1.2.3:1234", nil, "10.1.2.3", "trusted proxy without X-Forwarded-For"},
+		{"[2001:db8::1]:1234", nil, "2001:db8::1", "IPv6"},
+	} {
+		req := httptest.NewRequest("GET", "http://example.org/query", nil)
+		req.RemoteAddr = test.remoteAddr
+		for _, forwardedFor := range test.forwardedFor {
+			req.Header.Add("X-Forwarded-For", forwardedFor)
+		}
+		if ip := filter.clientIP(req); ip != test.expectedIP {
+			t.Fatalf(`%s: clientIP() (%s) != %s`, test.name, ip, test.expectedIP)
+		}
+	}
+}
+
+func TestIPFilterAllows(t *testing.T) {
+	filter, err := newIPFilter([]string{"10.0.0.0/8,2001:db8::/32"}, []string{"10.6.6.0/24", "10.7.7.7"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, allowed := range map[string]bool{
+		"10.1.2.3":        true,
+		"2001:db8::1":     true,
+		"10.6.6.6":        false,
+		"10.7.7.7":        false,
+		"10.7.7.8":        true,
+		"192.0.2.1":       false,
+		"not-an-ip":       false,
+		"::ffff:10.1.2.3": true,
+	} {
+		if filter.allows(ip) != allowed {
+			t.Fatalf(`allows(%s) != %v`, ip, allowed)
+		}
+	}
+
+	denyOnly, err := newIPFilter(nil, []string{"192.0.2.0/24"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !denyOnly.allows("198.51.100.7") || denyOnly.allows("192.0.2.1") {
+		t.Fatalf(`a denylist without an allowlist should only deny its ranges`)
+	}
+
+	for _, cidr := range []string{"10.0.0.0/33", "10.0.0", "example.org"} {
+		_, err := newIPFilter([]string{cidr}, nil, nil)
+		if err == nil {
+			t.Fatalf(`newIPFilter() should fail with '%s'`, cidr)
+		}
+	}
+}
+
+func TestIPFilterHandler(t *testing.T) {
+	var logOutput bytes.Buffer
+	log.SetOutput(&logOutput)
+	defer log.SetOutput(&bytes.Buffer{})
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0,
+		withIPFilter([]string{"192.0.2.0/24"}, nil, []string{"10.0.0.1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		remoteAddr   string
+		forwardedFor string
+		statusCode   int
+	}{
+		{"192.0.2.7:1234", "", http.StatusOK},
+		{"198.51.100.7:1234", "", http.StatusForbidden},
+		{"198.51.100.7:1234", "192.0.2.7", http.StatusForbidden},
+		{"10.0.0.1:1234", "192.0.2.7", http.StatusOK},
+		{"10.0.0.1:1234", "198.51.100.7", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("POST", "http://example.org/query", strings.NewReader("github.com"))
+		req.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		queryHandler(w, req)
+
+		resp := w.Result()
+		if resp.StatusCode != test.statusCode {
+			t.Fatalf(`%s (X-Forwarded-For: %s): resp.StatusCode (%d) != %d`, test.remoteAddr, test.forwardedFor, resp.StatusCode, test.statusCode)
+		}
+	}
+
+	if !strings.Contains(logOutput.String(), "Rejected request from IP address 198.51.100.7") {
+		t.Fatalf(`rejected requests should be logged, got: %s`, logOutput.String())
+	}
+}
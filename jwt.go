@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	json "github.com/json-iterator/go"
+)
+
+// Clock skew tolerated when checking the "exp" and "nbf" claims
+const jwtLeeway = time.Minute
+
+// jwtSettings configures how JWTs are verified and which of their claims are bound as params
+type jwtSettings struct {
+	secretPath    string   // File of the HS256 shared secret, "" disables HS256
+	jwksPath      string   // JWKS file of the RS256 and ES256 public keys, "" disables them
+	issuer        string   // Required "iss" claim, "" means any
+	audience      string   // Required "aud" claim, "" means any
+	claimParams   []string // "param=claim" (or "claim" for a param of the same name)
+	identityClaim string   // Claim of the request's identity
+}
+
+// jwtVerifier verifies the signature and the claims of JWTs
+type jwtVerifier struct {
+	settings jwtSettings
+
+	secret     []byte                      // nil if HS256 is disabled
+	publicKeys map[string]crypto.PublicKey // By "kid", nil if RS256 and ES256 are disabled
+
+	claimParams map[string]string // Claim by param name
+}
+
+func newJWTVerifier(settings jwtSettings) (*jwtVerifier, error) {
+	if settings.secretPath == "" && settings.jwksPath == "" {
+		return nil, fmt.Errorf("Must provide --jwt-secret-file or --jwt-jwks param to verify JWTs")
+	}
+
+	if settings.identityClaim == "" {
+		settings.identityClaim = "sub"
+	}
+
+	verifier := &jwtVerifier{
+		settings:    settings,
+		claimParams: map[string]string{},
+	}
+
+	if settings.secretPath != "" {
+		secret, err := ioutil.ReadFile(settings.secretPath)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load JWT secret: %v", err)
+		}
+		verifier.secret = []byte(strings.TrimRight(string(secret), "\r\n"))
+		if len(verifier.secret) == 0 {
+			return nil, fmt.Errorf("JWT secret '%s' is empty", settings.secretPath)
+		}
+	}
+
+	if settings.jwksPath != "" {
+		publicKeys, err := loadJWKS(settings.jwksPath)
+		if err != nil {
+			return nil, err
+		}
+		verifier.publicKeys = publicKeys
+	}
+
+	for _, claimParam := range settings.claimParams {
+		param, claim := claimParam, claimParam
+		if eq := strings.Index(claimParam, "="); eq != -1 {
+			param, claim = strings.TrimSpace(claimParam[:eq]), strings.TrimSpace(claimParam[eq+1:])
+		}
+		if !namedParamRegex.MatchString(param) || claim == "" {
+			return nil, fmt.Errorf("JWT claim param '%s' must be 'param=claim'", claimParam)
+		}
+		verifier.claimParams[param] = claim
+	}
+
+	return verifier, nil
+}
+
+// jwk is a JSON Web Key, only the fields of RSA and P-256 EC public keys
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// loadJWKS loads the public keys of a JWKS file by their "kid"
+func loadJWKS(jwksPath string) (map[string]crypto.PublicKey, error) {
+	jwksJSON, err := ioutil.ReadFile(jwksPath)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load JWKS: %v", err)
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = json.Unmarshal(jwksJSON, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load JWKS '%s': %v", jwksPath, err)
+	}
+
+	publicKeys := map[string]crypto.PublicKey{}
+	for _, key := range jwks.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+
+		publicKey, err := key.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load JWKS '%s': key '%s': %v", jwksPath, key.Kid, err)
+		}
+		publicKeys[key.Kid] = publicKey
+	}
+	if len(publicKeys) == 0 {
+		return nil, fmt.Errorf("Cannot load JWKS '%s': no signing keys", jwksPath)
+	}
+
+	return publicKeys, nil
+}
+
+func (key jwk) publicKey() (crypto.PublicKey, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'n': %v", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'e': %v", err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > math.MaxInt32 || exponent.Int64() < 3 {
+			return nil, fmt.Errorf("invalid 'e'")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		if key.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve '%s', must be P-256", key.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'x': %v", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(key.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'y': %v", err)
+		}
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, fmt.Errorf("point isn't on curve P-256")
+		}
+		return publicKey, nil
+	}
+	return nil, fmt.Errorf("unsupported key type '%s', must be RSA or EC", key.Kty)
+}
+
+// isJWT reports whether token looks like a JWT (and not like an API key)
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// jwtClaims are the claims of a JWT, as their JSON
+type jwtClaims map[string]json.RawMessage
+
+// get returns the value of the claim name, nil if it's missing
+func (claims jwtClaims) get(name string) interface{} {
+	var value interface{}
+	if claims[name] != nil && json.Unmarshal(claims[name], &value) == nil {
+		return value
+	}
+	return nil
+}
+
+// verify verifies token's signature and its "exp", "nbf", "iss" and "aud" claims,
+// and returns its claims
+func (verifier *jwtVerifier) verify(token string, now time.Time) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Invalid JWT: must have 3 parts")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JWT header: %v", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = json.Unmarshal(headerJSON, &header)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JWT header: %v", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JWT signature: %v", err)
+	}
+
+	err = verifier.verifySignature(header.Alg, header.Kid, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return nil, err
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JWT claims: %v", err)
+	}
+	var claims jwtClaims
+	err = json.Unmarshal(claimsJSON, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JWT claims: %v", err)
+	}
+
+	if exp, ok := claims.get("exp").(float64); ok && now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, fmt.Errorf("JWT expired at %s", time.Unix(int64(exp), 0).UTC().Format(time.RFC3339))
+	} else if !ok && claims.get("exp") != nil {
+		return nil, fmt.Errorf("Invalid JWT 'exp' claim")
+	}
+	if nbf, ok := claims.get("nbf").(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("JWT isn't valid before %s", time.Unix(int64(nbf), 0).UTC().Format(time.RFC3339))
+	} else if !ok && claims.get("nbf") != nil {
+		return nil, fmt.Errorf("Invalid JWT 'nbf' claim")
+	}
+
+	if iss := claims.get("iss"); verifier.settings.issuer != "" && iss != verifier.settings.issuer {
+		return nil, fmt.Errorf("JWT issuer '%v' isn't '%s'", iss, verifier.settings.issuer)
+	}
+	if aud := claims.get("aud"); verifier.settings.audience != "" && !hasAudience(aud, verifier.settings.audience) {
+		return nil, fmt.Errorf("JWT audience '%v' doesn't include '%s'", aud, verifier.settings.audience)
+	}
+
+	return claims, nil
+}
+
+func (verifier *jwtVerifier) verifySignature(alg string, kid string, signed string, signature []byte) error {
+	hash := sha256.Sum256([]byte(signed))
+
+	// The key is chosen by the server's settings, never by the token's "alg"
+	switch alg {
+	case "HS256":
+		if verifier.secret == nil {
+			break
+		}
+		mac := hmac.New(sha256.New, verifier.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return fmt.Errorf("Invalid JWT signature")
+		}
+		return nil
+	case "RS256":
+		publicKey, ok := verifier.publicKey(kid).(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("Unknown JWT key '%s' for RS256", kid)
+		}
+		if rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], signature) != nil {
+			return fmt.Errorf("Invalid JWT signature")
+		}
+		return nil
+	case "ES256":
+		publicKey, ok := verifier.publicKey(kid).(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("Unknown JWT key '%s' for ES256", kid)
+		}
+		if len(signature) != 64 {
+			return fmt.Errorf("Invalid JWT signature")
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(publicKey, hash[:], r, s) {
+			return fmt.Errorf("Invalid JWT signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported JWT algorithm '%s'", alg)
+}
+
+// publicKey returns the JWKS key of kid, or the only key if kid is empty
+func (verifier *jwtVerifier) publicKey(kid string) crypto.PublicKey {
+	if kid == "" && len(verifier.publicKeys) == 1 {
+		for _, publicKey := range verifier.publicKeys {
+			return publicKey
+		}
+	}
+	return verifier.publicKeys[kid]
+}
+
+// hasAudience reports whether the "aud" claim (a string or an array of strings) includes audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, value := range aud {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// identity returns the request's identity from claims
+func (verifier *jwtVerifier) identity(claims jwtClaims) string {
+	identity, _ := claims.get(verifier.settings.identityClaim).(string)
+	return identity
+}
+
+// claimParamNames returns the names of the params bound from claims, none if verifier is nil.
+// The server owns them even for requests that aren't authenticated with a JWT (e.g. by an API key).
+func (verifier *jwtVerifier) claimParamNames() []string {
+	if verifier == nil {
+		return nil
+	}
+	names := make([]string, 0, len(verifier.claimParams))
+	for param := range verifier.claimParams {
+		names = append(names, param)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// boundParams returns the named params bound from claims.
+// A token without one of the claims is rejected, so the param is never left for the request to set.
+func (verifier *jwtVerifier) boundParams(claims jwtClaims) ([]sql.NamedArg, error) {
+	boundParams := make([]sql.NamedArg, 0, len(verifier.claimParams))
+	for param, claim := range verifier.claimParams {
+		value := claims.get(claim)
+		if value == nil {
+			return nil, fmt.Errorf("JWT doesn't have the '%s' claim of param ':%s'", claim, param)
+		}
+		boundParams = append(boundParams, sql.Named(param, claimValue(value, claims[claim])))
+	}
+
+	// Sorted so the results cache and the ETags see the same params for the same claims
+	sort.Slice(boundParams, func(i, j int) bool {
+		return boundParams[i].Name < boundParams[j].Name
+	})
+	return boundParams, nil
+}
+
+// claimValue converts a JSON claim to a SQLite value:
+// integers to INTEGER, strings to TEXT, and arrays and objects to their JSON TEXT
+func claimValue(value interface{}, valueJSON json.RawMessage) interface{} {
+	switch value := value.(type) {
+	case float64:
+		if value == math.Trunc(value) && math.Abs(value) < 1<<53 {
+			return int64(value)
+		}
+		return value
+	case string, bool:
+		return value
+	}
+	return string(valueJSON)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/assafmo/SQLiteQueryServer/client"
+	json "github.com/json-iterator/go"
+)
+
+type testJWTClaims struct {
+	Sub    string      `json:"sub,omitempty"`
+	Iss    string      `json:"iss,omitempty"`
+	Aud    interface{} `json:"aud,omitempty"`
+	Exp    int64       `json:"exp,omitempty"`
+	Nbf    int64       `json:"nbf,omitempty"`
+	Tenant interface{} `json:"tenant,omitempty"`
+}
+
+// signTestJWT signs claims with alg, key is a []byte secret, an *rsa.PrivateKey or an *ecdsa.PrivateKey
+func signTestJWT(t *testing.T, alg string, kid string, key interface{}, claims testJWTClaims) string {
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid,omitempty"`
+	}{alg, kid}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	hash := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// writeTestJWKS writes a JWKS file with the public keys of rsaKey ("rsa-1") and ecKey ("ec-1")
+func writeTestJWKS(t *testing.T, jwksPath string, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) {
+	encode := func(n *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(n.Bytes())
+	}
+
+	jwks := struct {
+		Keys []jwk `json:"keys"`
+	}{[]jwk{
+		{Kty: "RSA", Kid: "rsa-1", Use: "sig", N: encode(rsaKey.N), E: encode(big.NewInt(int64(rsaKey.E)))},
+		{Kty: "EC", Kid: "ec-1", Crv: "P-256", X: encode(ecKey.X), Y: encode(ecKey.Y)},
+	}}
+	jwksJSON, err := json.Marshal(jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(jwksPath, jwksJSON, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWTVerify(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	secret := []byte("s3cr3t")
+	secretPath := filepath.Join(tmpDir, "secret")
+	err = ioutil.WriteFile(secretPath, append(secret, '\n'), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksPath := filepath.Join(tmpDir, "jwks.json")
+	writeTestJWKS(t, jwksPath, rsaKey, ecKey)
+
+	verifier, err := newJWTVerifier(jwtSettings{secretPath: secretPath, jwksPath: jwksPath, issuer: "auth.example.org", audience: "sqs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksVerifier, err := newJWTVerifier(jwtSettings{jwksPath: jwksPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	claims := func(override func(*testJWTClaims)) testJWTClaims {
+		claims := testJWTClaims{
+			Sub: "billing",
+			Iss: "auth.example.org",
+			Aud: []string{"other", "sqs"},
+			Exp: now.Add(time.Hour).Unix(),
+			Nbf: now.Add(-time.Hour).Unix(),
+		}
+		if override != nil {
+			override(&claims)
+		}
+		return claims
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		verifier *jwtVerifier
+		token    string
+		valid    bool
+	}{
+		{"HS256", verifier, signTestJWT(t, "HS256", "", secret, claims(nil)), true},
+		{"RS256", verifier, signTestJWT(t, "RS256", "rsa-1", rsaKey, claims(nil)), true},
+		{"ES256", verifier, signTestJWT(t, "ES256", "ec-1", ecKey, claims(nil)), true},
+		{"HS256 wrong secret", verifier, signTestJWT(t, "HS256", "", []byte("nope"), claims(nil)), false},
+		{"HS256 without secret", jwksVerifier, signTestJWT(t, "HS256", "", secret, claims(nil)), false},
+		{"ES256 wrong key", verifier, signTestJWT(t, "ES256", "ec-1", otherKey, claims(nil)), false},
+		{"RS256 unknown kid", verifier, signTestJWT(t, "RS256", "rsa-2", rsaKey, claims(nil)), false},
+		{"RS256 with EC kid", verifier, signTestJWT(t, "RS256", "ec-1", rsaKey, claims(nil)), false},
+		{"none", verifier, strings.TrimSuffix(signTestJWT(t, "none", "", []byte{}, claims(nil)), "."), false},
+		{"expired", verifier, signTestJWT(t, "HS256", "", secret, claims(func(c *testJWTClaims) { c.Exp = now.Add(-time.Hour).Unix() })), false},
+		{"not yet valid", verifier, signTestJWT(t, "HS256", "", secret, claims(func(c *testJWTClaims) { c.Nbf = now.Add(time.Hour).Unix() })), false},
+		{"wrong issuer", verifier, signTestJWT(t, "HS256", "", secret, claims(func(c *testJWTClaims) { c.Iss = "evil.example.org" })), false},
+		{"wrong audience", verifier, signTestJWT(t, "HS256", "", secret, claims(func(c *testJWTClaims) { c.Aud = "other" })), false},
+		{"string audience", verifier, signTestJWT(t, "HS256", "", secret, claims(func(c *testJWTClaims) { c.Aud = "sqs" })), true},
+	} {
+		verifiedClaims, err := test.verifier.verify(test.token, now)
+		if test.valid && err != nil {
+			t.Fatalf(`%s: verify() failed: %v`, test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf(`%s: verify() should fail`, test.name)
+		}
+		if test.valid && test.verifier.identity(verifiedClaims) != "billing" {
+			t.Fatalf(`%s: identity() (%s) != billing`, test.name, test.verifier.identity(verifiedClaims))
+		}
+	}
+}
+
+func TestJWTClaimParams(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	secret := []byte("s3cr3t")
+	secretPath := filepath.Join(tmpDir, "secret")
+	err = ioutil.WriteFile(secretPath, secret, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ? AND :tenant_id = 'acme'", 0,
+		withJWT(jwtSettings{secretPath: secretPath, claimParams: []string{"tenant_id=tenant"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acmeToken := signTestJWT(t, "HS256", "", secret, testJWTClaims{Sub: "billing", Tenant: "acme"})
+	otherToken := signTestJWT(t, "HS256", "", secret, testJWTClaims{Sub: "billing", Tenant: "other"})
+	noTenantToken := signTestJWT(t, "HS256", "", secret, testJWTClaims{Sub: "billing"})
+
+	for _, test := range []struct {
+		method     string
+		url        string
+		body       string
+		token      string
+		statusCode int
+		rows       int
+	}{
+		{"POST", "http://example.org/query", "github.com", acmeToken, http.StatusOK, 2},
+		{"GET", "http://example.org/query?p=github.com", "", acmeToken, http.StatusOK, 2},
+		{"POST", "http://example.org/query", "github.com", otherToken, http.StatusOK, 0},
+		{"GET", "http://example.org/query?p=github.com&tenant_id=acme", "", otherToken, http.StatusBadRequest, 0},
+		{"POST", "http://example.org/query", "github.com,acme", otherToken, http.StatusInternalServerError, 0},
+		{"POST", "http://example.org/query", "github.com", noTenantToken, http.StatusForbidden, 0},
+		{"POST", "http://example.org/query", "github.com", "", http.StatusUnauthorized, 0},
+	} {
+		req := httptest.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		queryHandler(w, req)
+
+		resp := w.Result()
+		if resp.StatusCode != test.statusCode {
+			t.Fatalf(`%s %s %s: resp.StatusCode (%d) != %d`, test.method, test.url, test.body, resp.StatusCode, test.statusCode)
+		}
+		if resp.StatusCode != http.StatusOK {
+			continue
+		}
+
+		var fullResponse []queryResult
+		err = json.NewDecoder(resp.Body).Decode(&fullResponse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fullResponse) != 1 || len(fullResponse[0].Out) != test.rows {
+			t.Fatalf(`%s %s %s: fullResponse (%v) should have %d rows`, test.method, test.url, test.body, fullResponse, test.rows)
+		}
+	}
+}
+
+func TestJWTClaimParamsWithOtherCredentials(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	secret := []byte("s3cr3t")
+	secretPath := filepath.Join(tmpDir, "secret")
+	err = ioutil.WriteFile(secretPath, secret, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyringPath := filepath.Join(tmpDir, "keyring.json")
+	err = ioutil.WriteFile(keyringPath, []byte(`{"etl": "0th3r"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings := jwtSettings{secretPath: secretPath, claimParams: []string{"tenant_id=tenant"}}
+	tenantHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ? AND :tenant_id = 'acme'", 0,
+		withJWT(settings), withSigning(keyringPath, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = :dns", 0,
+		withJWT(settings), withSigning(keyringPath, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acmeToken := signTestJWT(t, "HS256", "", secret, testJWTClaims{Sub: "billing", Tenant: "acme"})
+	signer := client.Signer{KeyID: "etl", Secret: []byte("0th3r")}
+
+	for _, test := range []struct {
+		name         string
+		queryHandler http.HandlerFunc
+		method       string
+		url          string
+		body         string
+		jwt          bool
+		statusCode   int
+	}{
+		{"JWT", tenantHandler, "POST", "http://example.org/query", "github.com", true, http.StatusOK},
+		{"signed", tenantHandler, "POST", "http://example.org/query", "github.com", false, http.StatusForbidden},
+		{"signed with the claim param in the CSV", tenantHandler, "POST", "http://example.org/query", "github.com,acme", false, http.StatusForbidden},
+		{"signed with the claim param in the URL", tenantHandler, "GET", "http://example.org/query?p=github.com&tenant_id=acme", "", false, http.StatusBadRequest},
+		{"signed to a query without the claim param", otherHandler, "GET", "http://example.org/query?dns=github.com", "", false, http.StatusOK},
+		{"signed with the claim param in the URL of a query without it", otherHandler, "GET", "http://example.org/query?dns=github.com&tenant_id=acme", "", false, http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		if test.jwt {
+			req.Header.Set("Authorization", "Bearer "+acmeToken)
+		} else {
+			err = signer.Sign(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		w := httptest.NewRecorder()
+		test.queryHandler(w, req)
+
+		if w.Result().StatusCode != test.statusCode {
+			t.Fatalf(`%s: resp.StatusCode (%d) != %d`, test.name, w.Result().StatusCode, test.statusCode)
+		}
+	}
+}
+
+func TestQueryNamedParams(t *testing.T) {
+	names := queryNamedParams("SELECT ':quoted', \"a:b\", [c:d] FROM t -- :comment\nWHERE a = :tenant_id /* :block */ AND b = ? AND c = :x1")
+	if len(names) != 2 || !names["tenant_id"] || !names["x1"] {
+		t.Fatalf(`queryNamedParams() (%v) != [tenant_id x1]`, names)
+	}
+}
@@ -1,17 +1,28 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
 	"encoding/csv"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	json "github.com/json-iterator/go"
 	_ "github.com/mattn/go-sqlite3"
@@ -26,6 +37,10 @@ func main() {
 }
 
 func cmd(cmdArgs []string) error {
+	if len(cmdArgs) > 0 && cmdArgs[0] == "keys" {
+		return keysCmd(cmdArgs[1:], os.Stdout)
+	}
+
 	log.Printf("SQLiteQueryServer v%s\n", version)
 	log.Println("https://github.com/assafmo/SQLiteQueryServer")
 
@@ -35,18 +50,213 @@ func cmd(cmdArgs []string) error {
 	var dbPath string
 	var queryString string
 	var serverPort uint
+	var registryPath string
+	var adminAddr string
+	var timeout time.Duration
+	var requestLimits limits
+	var cursorColumn string
+	var cacheMaxBytes int64
+	var cacheTTL time.Duration
+	var cacheControl string
+	var bloomKey string
+	var bloomParam int
+	var bloomFalsePosRate float64
+	var inMemory bool
+	var reloadInterval time.Duration
+	var watchInterval time.Duration
+	var shutdownTimeout time.Duration
+	var tlsCert string
+	var tlsKey string
+	var tlsMinVersion string
+	var clientCA string
+	var clientACLPath string
+	var keysPath string
+	var jwt jwtSettings
+	var jwtClaims stringsFlag
+	var bindParams stringsFlag
+	var cors corsSettings
+	var corsOrigins stringsFlag
+	var corsMethods string
+	var corsHeaders string
+	var corsExposeHeaders string
+	var clientQuotas quotaSettings
+	var allowCIDRs stringsFlag
+	var denyCIDRs stringsFlag
+	var trustedProxies stringsFlag
+	var signingKeyring string
+	var signingWindow time.Duration
+	var redactionPolicyPath string
+	var pragmas stringsFlag
+	var initSQL string
+	var openMode string
 
-	flagSet.StringVar(&dbPath, "db", "", "Filesystem path of the SQLite database")
+	flagSet.StringVar(&dbPath, "db", "", "Filesystem path of the SQLite database, can be compressed (.gz or .zst)")
 	flagSet.StringVar(&queryString, "query", "", "SQL query to prepare for")
 	flagSet.UintVar(&serverPort, "port", 80, "HTTP port to listen on")
+	flagSet.StringVar(&openMode, "open-mode", openModeReadWrite, "How to open the database: rw (WAL mode), ro (read-only) or immutable (read-only without locking, for read-only media)")
+	flagSet.StringVar(&registryPath, "registry", "", "Filesystem path of the SQLite database to persist registered queries in (created if missing)")
+	flagSet.StringVar(&tlsCert, "tls-cert", "", "Filesystem path of the TLS certificate (PEM) to serve HTTPS with, reloaded when it changes or on SIGHUP")
+	flagSet.StringVar(&tlsKey, "tls-key", "", "Filesystem path of the TLS private key (PEM) of --tls-cert")
+	flagSet.StringVar(&tlsMinVersion, "tls-min-version", "1.2", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	flagSet.StringVar(&clientCA, "client-ca", "", "Filesystem path of the CA certificates (PEM) that clients must present a certificate of, requires --tls-cert")
+	flagSet.StringVar(&clientACLPath, "client-acl", "", "Filesystem path of a JSON file mapping client certificate identities to the endpoints they may call, requires --client-ca")
+	flagSet.StringVar(&keysPath, "keys-db", "", "Filesystem path of the SQLite database of the API keys that requests must present (managed with the keys subcommand)")
+	flagSet.StringVar(&signingKeyring, "signing-keyring", "", "Filesystem path of a JSON file mapping key IDs to the shared secrets of HMAC-SHA256 signed requests (see the client package)")
+	flagSet.DurationVar(&signingWindow, "signing-window", 5*time.Minute, "Max difference between a signed request's timestamp and the server's time, a signature can't be replayed within it")
+	flagSet.StringVar(&jwt.secretPath, "jwt-secret-file", "", "Filesystem path of the shared secret to verify HS256 JWTs with")
+	flagSet.StringVar(&jwt.jwksPath, "jwt-jwks", "", "Filesystem path of a JWKS file of the public keys to verify RS256 and ES256 JWTs with")
+	flagSet.StringVar(&jwt.issuer, "jwt-issuer", "", "Required 'iss' claim of JWTs")
+	flagSet.StringVar(&jwt.audience, "jwt-audience", "", "Required 'aud' claim of JWTs")
+	flagSet.StringVar(&jwt.identityClaim, "jwt-identity-claim", "sub", "JWT claim of the request's identity")
+	flagSet.Var(&jwtClaims, "jwt-claim", "JWT claim to bind as a named query param as 'param=claim' (e.g. tenant_id=tenant), can be repeated")
+	flagSet.Var(&allowCIDRs, "allow-cidr", "CIDR range or IP address that may call the server (e.g. 10.0.0.0/8), others are denied, can be repeated or comma separated")
+	flagSet.Var(&denyCIDRs, "deny-cidr", "CIDR range or IP address that may not call the server, even if allowed by --allow-cidr, can be repeated or comma separated")
+	flagSet.Var(&trustedProxies, "trusted-proxy", "CIDR range or IP address of a reverse proxy whose X-Forwarded-For header is trusted for the client's IP address, can be repeated or comma separated")
+	flagSet.StringVar(&redactionPolicyPath, "redaction-policy", "", "Filesystem path of a JSON file of rules that drop, hash, truncate or mask result columns by endpoint and identity")
+	flagSet.StringVar(&adminAddr, "admin-addr", "", "Address for the admin API to listen on (e.g. 127.0.0.1:8081), requires --registry or client quotas")
+	flagSet.DurationVar(&timeout, "timeout", 0, "Max duration of a request's queries execution (e.g. 500ms, 10s), 0 means no timeout")
+	flagSet.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "Max duration to wait for in-flight requests on shutdown (SIGTERM or SIGINT) before canceling them")
+	flagSet.Int64Var(&requestLimits.maxBodyBytes, "max-body-bytes", 0, "Max size of a request body in bytes, 0 means unlimited")
+	flagSet.IntVar(&requestLimits.maxLines, "max-lines", 0, "Max number of lines (queries) in a request body, 0 means unlimited")
+	flagSet.IntVar(&requestLimits.maxRowsPerLine, "max-rows-per-line", 0, "Max number of rows returned for each line, 0 means unlimited")
+	flagSet.IntVar(&requestLimits.maxTotalRows, "max-total-rows", 0, "Max number of rows returned for a request, 0 means unlimited")
+	flagSet.StringVar(&cursorColumn, "cursor-column", "", "Column to order by for keyset pagination of a static query (default LIMIT/OFFSET pagination)")
+	flagSet.Int64Var(&cacheMaxBytes, "cache-max-bytes", 0, "Max memory in bytes for caching results of read-only queries, 0 disables caching")
+	flagSet.DurationVar(&cacheTTL, "cache-ttl", 0, "Max duration to keep a cached result (e.g. 1h), 0 means until the database changes")
+	flagSet.StringVar(&cacheControl, "cache-control", "no-cache", "Cache-Control header of GET responses")
+	flagSet.StringVar(&bloomKey, "bloom-key", "", "Key column ('table.column') to build a Bloom filter of, for skipping queries that can't match any row")
+	flagSet.IntVar(&bloomParam, "bloom-param", 1, "Index (1-based) of the query param that is compared to --bloom-key")
+	flagSet.Float64Var(&bloomFalsePosRate, "bloom-fp-rate", 0.01, "Target false positive rate of the Bloom filter")
+	flagSet.BoolVar(&inMemory, "in-memory", false, "Copy the database into memory before serving it")
+	flagSet.DurationVar(&reloadInterval, "reload-interval", 0, "Reload the database file every interval (e.g. 1h), 0 means only on SIGHUP or when watched")
+	flagSet.DurationVar(&watchInterval, "watch-interval", 0, "Check the database file for changes every interval (e.g. 5s) and reload it when it's replaced, 0 disables watching")
+	flagSet.Var(&corsOrigins, "cors-origin", "Origin that browsers may call the server from (e.g. https://dashboard.example.org or https://*.example.org), can be repeated (default *)")
+	flagSet.StringVar(&corsMethods, "cors-methods", defaultCORSMethods, "Comma separated methods that browsers may call the server with")
+	flagSet.StringVar(&corsHeaders, "cors-headers", defaultCORSHeaders, "Comma separated request headers that browsers may send")
+	flagSet.StringVar(&corsExposeHeaders, "cors-expose-headers", defaultCORSExposeHeaders, "Comma separated response headers that browsers expose to scripts")
+	flagSet.BoolVar(&cors.credentials, "cors-credentials", false, "Allow browsers to send cookies and HTTP authentication, requires --cors-origin")
+	flagSet.DurationVar(&cors.maxAge, "cors-max-age", 0, "Duration that browsers may cache a preflight response (e.g. 10m), 0 means the browser's default")
+	flagSet.Float64Var(&clientQuotas.requestsRate, "client-rate", 0, "Max requests per second of each client (API key, JWT or certificate identity, or IP address), 0 means unlimited")
+	flagSet.IntVar(&clientQuotas.requestsBurst, "client-burst", 0, "Max burst of requests of each client above --client-rate (default ceil of --client-rate)")
+	flagSet.Float64Var(&clientQuotas.linesRate, "client-lines-rate", 0, "Max lines (queries) per second of each client, 0 means unlimited")
+	flagSet.IntVar(&clientQuotas.linesBurst, "client-lines-burst", 0, "Max burst of lines of each client above --client-lines-rate (default ceil of --client-lines-rate)")
+	flagSet.IntVar(&clientQuotas.maxConcurrent, "client-max-concurrent", 0, "Max requests in flight of each client, 0 means unlimited")
+	flagSet.Var(&bindParams, "bind-param", "Named query param to fill from the request's metadata as 'name=source', source is header:<name>, client_ip, identity, now or now_unix (e.g. caller=identity), can be repeated")
+	flagSet.Var(&pragmas, "pragma", "PRAGMA to set on every database connection as 'name=value' (e.g. mmap_size=268435456), can be repeated")
+	flagSet.StringVar(&initSQL, "init-sql", "", "SQL to execute on every database connection, after the PRAGMAs")
 
 	err := flagSet.Parse(cmdArgs)
 	if err != nil {
 		return err
 	}
 
+	if adminAddr != "" && registryPath == "" && !clientQuotas.enabled() {
+		return fmt.Errorf("Must provide --registry param or client quota params when using --admin-addr")
+	}
+	if (tlsCert == "") != (tlsKey == "") {
+		return fmt.Errorf("Must provide both --tls-cert and --tls-key params")
+	}
+	if clientCA != "" && tlsCert == "" {
+		return fmt.Errorf("Must provide --tls-cert param when using --client-ca")
+	}
+	if clientACLPath != "" && clientCA == "" {
+		return fmt.Errorf("Must provide --client-ca param when using --client-acl")
+	}
+	if len(jwtClaims) > 0 && jwt.secretPath == "" && jwt.jwksPath == "" {
+		return fmt.Errorf("Must provide --jwt-secret-file or --jwt-jwks param when using --jwt-claim")
+	}
+
+	var tlsConfig *tls.Config
+	if tlsCert != "" {
+		minVersion, err := parseTLSVersion(tlsMinVersion)
+		if err != nil {
+			return err
+		}
+
+		reloader, err := newCertReloader(tlsCert, tlsKey)
+		if err != nil {
+			return err
+		}
+
+		// The database has its own SIGHUP channel (see withReload()),
+		// every notified channel gets its own copy of the signal
+		certReloadSignal := make(chan os.Signal, 1)
+		signal.Notify(certReloadSignal, syscall.SIGHUP)
+		go reloader.reloadLoop(certWatchInterval, certReloadSignal)
+
+		var clientCAs *x509.CertPool
+		if clientCA != "" {
+			clientCAs, err = loadClientCAs(clientCA)
+			if err != nil {
+				return err
+			}
+		}
+
+		tlsConfig = reloader.tlsConfig(minVersion, clientCAs)
+	}
+
+	var opts []handlerOption
+	if registryPath != "" {
+		opts = append(opts, withRegistry(registryPath))
+	}
+	if clientACLPath != "" {
+		opts = append(opts, withClientACL(clientACLPath))
+	}
+	if keysPath != "" {
+		opts = append(opts, withKeyStore(keysPath))
+	}
+	if signingKeyring != "" {
+		opts = append(opts, withSigning(signingKeyring, signingWindow))
+	}
+	if jwt.secretPath != "" || jwt.jwksPath != "" {
+		jwt.claimParams = jwtClaims
+		opts = append(opts, withJWT(jwt))
+	}
+	if len(bindParams) > 0 {
+		opts = append(opts, withRequestParams(bindParams))
+	}
+	if redactionPolicyPath != "" {
+		opts = append(opts, withRedactionPolicy(redactionPolicyPath))
+	}
+	cors.origins = corsOrigins
+	if len(cors.origins) == 0 {
+		cors.origins = []string{"*"}
+	}
+	cors.methods = splitList(corsMethods)
+	cors.headers = splitList(corsHeaders)
+	cors.exposeHeaders = splitList(corsExposeHeaders)
+	opts = append(opts, withCORS(cors))
+	opts = append(opts, withQuotas(clientQuotas))
+	if len(allowCIDRs) > 0 || len(denyCIDRs) > 0 || len(trustedProxies) > 0 {
+		opts = append(opts, withIPFilter(allowCIDRs, denyCIDRs, trustedProxies))
+	}
+	if timeout > 0 {
+		opts = append(opts, withTimeout(timeout))
+	}
+	opts = append(opts, withLimits(requestLimits))
+	if cursorColumn != "" {
+		opts = append(opts, withCursorColumn(cursorColumn))
+	}
+	if cacheMaxBytes > 0 {
+		opts = append(opts, withCache(cacheMaxBytes, cacheTTL))
+	}
+	opts = append(opts, withCacheControl(cacheControl))
+	opts = append(opts, withOpenMode(openMode))
+	if bloomKey != "" {
+		opts = append(opts, withBloomFilter(bloomKey, bloomParam, bloomFalsePosRate))
+	}
+	if len(pragmas) > 0 || initSQL != "" {
+		opts = append(opts, withConnectionInit(pragmas, initSQL))
+	}
+	if inMemory {
+		opts = append(opts, withInMemory())
+	}
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+	opts = append(opts, withReload(reloadInterval, watchInterval, reloadSignal))
+
 	// Init db and query
-	queryHandler, err := initQueryHandler(dbPath, queryString, serverPort)
+	server, err := newQueryServer(dbPath, queryString, serverPort, opts...)
 	if err != nil {
 		return err
 	}
@@ -55,19 +265,272 @@ func cmd(cmdArgs []string) error {
 	log.Printf("Starting server on port %d...\n", serverPort)
 	log.Printf("Starting server with query '%s'...\n", queryString)
 
-	http.HandleFunc("/query", queryHandler)
-	err = http.ListenAndServe(fmt.Sprintf(":%d", serverPort), nil)
+	publicListener, err := net.Listen("tcp", fmt.Sprintf(":%d", serverPort))
+	if err != nil {
+		server.close()
+		return err
+	}
 
-	return err
+	var adminListener net.Listener
+	if adminAddr != "" {
+		log.Printf("Starting admin API on %s...\n", adminAddr)
+		adminListener, err = net.Listen("tcp", adminAddr)
+		if err != nil {
+			publicListener.Close()
+			server.close()
+			return err
+		}
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+
+	return serve(server, publicListener, adminListener, tlsConfig, shutdownTimeout, stop)
 }
 
 type queryResult struct {
-	In      []string        `json:"in"`
-	Headers []string        `json:"headers"`
-	Out     [][]interface{} `json:"out"`
+	In        []string        `json:"in"`
+	Headers   []string        `json:"headers"`
+	Out       [][]interface{} `json:"out"`
+	Truncated bool            `json:"truncated,omitempty"`
+	Next      string          `json:"next,omitempty"`
+}
+
+// limits protect the server from runaway requests, 0 means unlimited
+type limits struct {
+	maxBodyBytes   int64
+	maxLines       int
+	maxRowsPerLine int
+	maxTotalRows   int
+}
+
+// handlerOptions holds the optional settings of the query handler
+type handlerOptions struct {
+	registryPath string
+	timeout      time.Duration
+	limits       limits
+	cursorColumn string
+
+	cacheMaxBytes int64
+	cacheTTL      time.Duration
+	cacheControl  string
+
+	bloomKey          string
+	bloomParam        int
+	bloomFalsePosRate float64
+
+	inMemory       bool
+	reloadInterval time.Duration
+	watchInterval  time.Duration
+	reloadSignal   <-chan os.Signal
+
+	pragmas []string
+	initSQL string
+
+	openMode string
+
+	clientACLPath string
+	keysPath      string
+
+	signingKeyringPath string
+	signingWindow      time.Duration
+
+	jwt *jwtSettings
+
+	bindParams []string
+
+	redactionPolicyPath string
+
+	cors *corsSettings
+
+	quotas quotaSettings
+
+	allowCIDRs     []string
+	denyCIDRs      []string
+	trustedProxies []string
+}
+
+type handlerOption func(*handlerOptions)
+
+// withRegistry enables the persisted query registry stored in registryPath
+func withRegistry(registryPath string) handlerOption {
+	return func(opts *handlerOptions) {
+		opts.registryPath = registryPath
+	}
+}
+
+// withTimeout limits the execution time of a request's queries.
+// Requests can only lower it with the X-Query-Timeout header.
+func withTimeout(timeout time.Duration) handlerOption {
+	return func(opts *handlerOptions) {
+		opts.timeout = timeout
+	}
 }
 
-func initQueryHandler(dbPath string, queryString string, serverPort uint) (func(w http.ResponseWriter, r *http.Request), error) {
+// withLimits limits the size of requests and of their results.
+// Too large requests are rejected, too large results are truncated.
+func withLimits(requestLimits limits) handlerOption {
+	return func(opts *handlerOptions) {
+		opts.limits = requestLimits
+	}
+}
+
+// withCursorColumn enables keyset pagination of the static query by cursorColumn,
+// instead of LIMIT/OFFSET pagination
+func withCursorColumn(cursorColumn string) handlerOption {
+	return func(opts *handlerOptions) {
+		opts.cursorColumn = cursorColumn
+	}
+}
+
+// withCache caches the results of read-only queries, up to cacheMaxBytes.
+// Cached results expire after cacheTTL (0 means never) or when the database changes.
+func withCache(cacheMaxBytes int64, cacheTTL time.Duration) handlerOption {
+	return func(opts *handlerOptions) {
+		opts.cacheMaxBytes = cacheMaxBytes
+		opts.cacheTTL = cacheTTL
+	}
+}
+
+// withCacheControl sets the Cache-Control header of GET responses
+func withCacheControl(cacheControl string) handlerOption {
+	return func(opts *handlerOptions) {
+		opts.cacheControl = cacheControl
+	}
+}
+
+// withBloomFilter skips executions of the query when the param at bloomParam (1-based)
+// can't match any value of bloomKey ("table.column"), using a Bloom filter
+func withBloomFilter(bloomKey string, bloomParam int, bloomFalsePosRate float64) handlerOption {
+	return func(opts *handlerOptions) {
+		opts.bloomKey = bloomKey
+		opts.bloomParam = bloomParam
+		opts.bloomFalsePosRate = bloomFalsePosRate
+	}
+}
+
+// withInMemory copies the database file into memory before serving it
+func withInMemory() handlerOption {
+	return func(opts *handlerOptions) {
+		opts.inMemory = true
+	}
+}
+
+// withReload reloads the database from its file every reloadInterval (if positive),
+// on every reloadSignal (if not nil), and when the file changes (checked every watchInterval, if positive).
+// An in-memory database is loaded again, and a database file is hot swapped.
+func withReload(reloadInterval time.Duration, watchInterval time.Duration, reloadSignal <-chan os.Signal) handlerOption {
+	return func(opts *handlerOptions) {
+		opts.reloadInterval = reloadInterval
+		opts.watchInterval = watchInterval
+		opts.reloadSignal = reloadSignal
+	}
+}
+
+// withConnectionInit sets pragmas ("name=value") and then executes initSQL
+// on every new database connection
+func withConnectionInit(pragmas []string, initSQL string) handlerOption {
+	return func(opts *handlerOptions) {
+		opts.pragmas = pragmas
+		opts.initSQL = initSQL
+	}
+}
+
+// withOpenMode sets how the database file is opened: rw, ro or immutable
+func withOpenMode(openMode string) handlerOption {
+	return func(opts *handlerOptions) {
+		opts.openMode = openMode
+	}
+}
+
+// withClientACL authorizes requests by the identity of their client certificate,
+// with the ACL in clientACLPath
+func withClientACL(clientACLPath string) handlerOption {
+	return func(opts *handlerOptions) {
+		opts.clientACLPath = clientACLPath
+	}
+}
+
+// withKeyStore authenticates requests by their API key,
+// with the keys stored in the SQLite database in keysPath
+func withKeyStore(keysPath string) handlerOption {
+	return func(opts *handlerOptions) {
+		opts.keysPath = keysPath
+	}
+}
+
+// withJWT authenticates requests by their JWT, and binds its claims as named params
+func withJWT(settings jwtSettings) handlerOption {
+	return func(opts *handlerOptions) {
+		opts.jwt = &settings
+	}
+}
+
+// withRequestParams fills named params from the request's metadata instead of from the request,
+// each of bindParams is "name=source" (see parseRequestParam())
+func withRequestParams(bindParams []string) handlerOption {
+	return func(opts *handlerOptions) {
+		opts.bindParams = bindParams
+	}
+}
+
+// withRedactionPolicy redacts result columns by the rules in the JSON file at policyPath (see redactionRule)
+func withRedactionPolicy(policyPath string) handlerOption {
+	return func(opts *handlerOptions) {
+		opts.redactionPolicyPath = policyPath
+	}
+}
+
+// withCORS sets which browser origins may call the server,
+// by default any origin may call it without credentials
+func withCORS(settings corsSettings) handlerOption {
+	return func(opts *handlerOptions) {
+		opts.cors = &settings
+	}
+}
+
+// withQuotas limits the request rate, the lines rate and the concurrent requests of each client
+func withQuotas(settings quotaSettings) handlerOption {
+	return func(opts *handlerOptions) {
+		opts.quotas = settings
+	}
+}
+
+// withIPFilter only allows clients in allowCIDRs (any if empty) and not in denyCIDRs,
+// taking the client's IP address from X-Forwarded-For of requests from trustedProxies
+func withIPFilter(allowCIDRs []string, denyCIDRs []string, trustedProxies []string) handlerOption {
+	return func(opts *handlerOptions) {
+		opts.allowCIDRs = allowCIDRs
+		opts.denyCIDRs = denyCIDRs
+		opts.trustedProxies = trustedProxies
+	}
+}
+
+// withSigning authenticates requests that are HMAC-SHA256 signed with a key of the keyring
+// at keyringPath, and signed within window of the server's time (see package client)
+func withSigning(keyringPath string, window time.Duration) handlerOption {
+	return func(opts *handlerOptions) {
+		opts.signingKeyringPath = keyringPath
+		opts.signingWindow = window
+	}
+}
+
+func initQueryHandler(dbPath string, queryString string, serverPort uint, opts ...handlerOption) (func(w http.ResponseWriter, r *http.Request), error) {
+	server, err := newQueryServer(dbPath, queryString, serverPort, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return server.serveHTTP, nil
+}
+
+// newQueryServer opens the database and prepares the query on it
+func newQueryServer(dbPath string, queryString string, serverPort uint, opts ...handlerOption) (*queryServer, error) {
+	var options handlerOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	// Init db and query
 
 	if dbPath == "" {
@@ -76,146 +539,840 @@ func initQueryHandler(dbPath string, queryString string, serverPort uint) (func(
 	if queryString == "" {
 		return nil, fmt.Errorf("Must provide --query param")
 	}
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("Database file '%s' doesn't exist", dbPath)
+	err := checkDatabaseFile(dbPath)
+	if err != nil {
+		return nil, err
 	}
 
-	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=rw&cache=shared&_journal_mode=WAL", dbPath))
+	_, err = databaseDSN(dbPath, options.openMode)
 	if err != nil {
 		return nil, err
 	}
 
-	db.SetMaxOpenConns(1)
+	driverName, err := initDriverName(options.pragmas, options.initSQL)
+	if err != nil {
+		return nil, err
+	}
 
-	queryStmt, err := db.Prepare(queryString)
+	server := &queryServer{
+		options:     options,
+		dbPath:      dbPath,
+		queryString: queryString,
+		serverPort:  serverPort,
+		driverName:  driverName,
+	}
+
+	server.ipFilter, err = newIPFilter(options.allowCIDRs, options.denyCIDRs, options.trustedProxies)
 	if err != nil {
-		db.Close()
 		return nil, err
 	}
 
-	helpMessage := buildHelpMessage("", queryString, queryStmt, serverPort)
+	if options.clientACLPath != "" {
+		server.clientACL, err = loadClientACL(options.clientACLPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if options.keysPath != "" {
+		server.keys, err = openKeyStore(options.keysPath)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Server", "SQLiteQueryServer v"+version)
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("X-Content-Type-Options", "nosniff")
+	if options.signingKeyringPath != "" {
+		server.signatures, err = newSignatureVerifier(options.signingKeyringPath, options.signingWindow)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		if r.URL.Path != "/query" {
-			http.Error(w, helpMessage, http.StatusNotFound)
+	if options.jwt != nil {
+		server.jwtVerifier, err = newJWTVerifier(*options.jwt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	corsSettings := corsSettings{
+		origins:       []string{"*"},
+		methods:       splitList(defaultCORSMethods),
+		headers:       splitList(defaultCORSHeaders),
+		exposeHeaders: splitList(defaultCORSExposeHeaders),
+	}
+	if options.cors != nil {
+		corsSettings = *options.cors
+	}
+	server.cors, err = newCORSPolicy(corsSettings)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.quotas.enabled() {
+		server.quotas, err = newQuotas(options.quotas)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if options.redactionPolicyPath != "" {
+		server.redaction, err = loadRedactionPolicy(options.redactionPolicyPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, bindParam := range options.bindParams {
+		param, err := parseRequestParam(bindParam)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range server.requestParams {
+			if other.name == param.name {
+				return nil, fmt.Errorf("Param ':%s' is bound more than once", param.name)
+			}
+		}
+		if server.jwtVerifier != nil && server.jwtVerifier.claimParams[param.name] != "" {
+			return nil, fmt.Errorf("Param ':%s' is bound more than once", param.name)
+		}
+		server.requestParams = append(server.requestParams, param)
+	}
+
+	if options.reloadInterval > 0 || options.watchInterval > 0 {
+		err = server.checkSwappable()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Changes of the file after it's opened are watched
+	dbInfo, err := os.Stat(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := server.openDatabase(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	server.current = handle
+	server.helpMessage = handle.query.helpMessage
+
+	db, query := handle.db, handle.query
+
+	if options.registryPath != "" {
+		server.registry, err = initRegistry(options.registryPath, db, serverPort)
+		if err != nil {
+			handle.close()
+			return nil, err
+		}
+	}
+
+	if options.cacheMaxBytes > 0 {
+		server.cache = newResultCache(options.cacheMaxBytes, options.cacheTTL)
+	}
+
+	if options.bloomKey != "" {
+		if !query.readOnly {
+			handle.close()
+			return nil, fmt.Errorf("Bloom filter is only supported for read-only queries")
+		}
+
+		dbVersion, err := server.dataVersion(context.Background(), handle)
+		if err != nil {
+			handle.close()
+			return nil, err
+		}
+
+		server.keyFilter, err = initKeyFilter(db, options.bloomKey, options.bloomParam, options.bloomFalsePosRate, dbVersion)
+		if err != nil {
+			handle.close()
+			return nil, err
+		}
+	}
+
+	if options.reloadInterval > 0 || options.watchInterval > 0 || options.reloadSignal != nil {
+		go server.reloadLoop(dbInfo, options.reloadInterval, options.watchInterval, options.reloadSignal)
+	}
+
+	return server, nil
+}
+
+// queryServer serves the query and the registered queries
+type queryServer struct {
+	options     handlerOptions
+	dbPath      string
+	queryString string
+	serverPort  uint
+	driverName  string // The SQLite driver, see initDriverName()
+	helpMessage string // The query's help message
+
+	mutex   sync.RWMutex
+	current *dbHandle // Swapped when the database file is reloaded
+	closed  bool
+
+	ipFilter *ipFilter
+
+	clientACL   clientACL          // nil if any client may call any endpoint
+	keys        *keyStore          // nil if requests don't need an API key
+	signatures  *signatureVerifier // nil if requests can't be signed
+	jwtVerifier *jwtVerifier       // nil if requests don't need a JWT
+
+	requestParams []requestParam // Named params filled from the request's metadata
+
+	redaction redactionPolicy // nil if columns aren't redacted
+
+	cors *corsPolicy
+
+	quotas *quotas // nil if clients are unlimited
+
+	registry *registry    // nil if the registry is disabled
+	cache    *resultCache // nil if caching is disabled
+	flights  flightGroup
+
+	keyFilter *keyFilter // Bloom filter of the query, nil if disabled
+
+	reloads uint64 // Times the database was reloaded, part of its version
+}
+
+// dataVersion returns the current version of the database of handle.
+// It changes whenever the database is modified or reloaded.
+func (server *queryServer) dataVersion(ctx context.Context, handle *dbHandle) (string, error) {
+	dbVersion, err := dataVersion(ctx, handle.db)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d:%s", handle.generation, dbVersion), nil
+}
+
+func (server *queryServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "SQLiteQueryServer v"+version)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	ip := server.ipFilter.clientIP(r)
+	if !server.ipFilter.allows(ip) {
+		log.Printf("Rejected request from IP address %s to '%s'\n", ip, r.URL.Path)
+		http.Error(w, fmt.Sprintf("\n\nIP address %s isn't allowed\n\n%s", ip, server.helpMessage), http.StatusForbidden)
+		return
+	}
+
+	server.cors.setHeaders(w, r)
+	if isPreflight(r) {
+		server.cors.preflight(w, r, server.helpMessage)
+		return
+	}
+
+	identity := clientIdentity(r)
+	if server.clientACL != nil {
+		if identity == "" {
+			http.Error(w, fmt.Sprintf("\n\nClient certificate is required\n\n%s", server.helpMessage), http.StatusForbidden)
 			return
 		}
-		if r.Method != "POST" && r.Method != "GET" {
-			http.Error(w, helpMessage, http.StatusMethodNotAllowed)
+		if !server.clientACL.allows(identity, r.URL.Path) {
+			http.Error(w, fmt.Sprintf("\n\nClient '%s' isn't allowed to call '%s'\n\n%s", identity, r.URL.Path, server.helpMessage), http.StatusForbidden)
 			return
 		}
+	}
 
-		// Init fullResponse
-		fullResponse := []queryResult{}
+	identity, boundParams, ok := server.authenticate(w, r, identity)
+	if !ok {
+		return
+	}
+	boundParams = append(boundParams, requestParams(server.requestParams, r, identity, ip, time.Now())...)
+	setRequestIdentity(r, identity)
+	redaction := server.redaction.rulesFor(identity, r.URL.Path)
 
-		var reqCsvReader *csv.Reader
-		if r.Method == "GET" {
-			// Static query
-			reqCsvReader = csv.NewReader(strings.NewReader(""))
-		} else {
-			// Parameterized query
-			reqCsvReader = csv.NewReader(r.Body)
-		}
-		reqCsvReader.FieldsPerRecord = -1
-
-		// Iterate over each query
-		for {
-			csvRecord, err := reqCsvReader.Read()
-			if r.Method == "POST" {
-				// Parameterized query
-				if err == io.EOF || err == http.ErrBodyReadAfterClose {
-					// EOF || last line is without \n
-					break
-				} else if err != nil {
-					http.Error(w, fmt.Sprintf("\n\nError reading request body: %v\n\n%s", err, helpMessage), http.StatusInternalServerError)
-					return
-				}
-			} else {
-				csvRecord = make([]string, 0)
+	if r.URL.Path == "/stats" {
+		server.statsHandler(w, r)
+		return
+	}
+	if server.registry != nil && strings.HasPrefix(r.URL.Path, "/admin/queries") {
+		server.registry.adminHandler(w, r)
+		return
+	}
+	if server.quotas != nil && r.URL.Path == "/admin/quotas" {
+		server.quotasHandler(w, r)
+		return
+	}
+
+	// Quotas are per authenticated client, or per IP address for anonymous clients
+	client := identity
+	if client == "" {
+		client = ip
+	}
+	if server.quotas != nil {
+		release, err := server.quotas.acquire(client, time.Now())
+		if quotaErr, ok := err.(*quotaError); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(quotaErr.retryAfter)))
+			http.Error(w, fmt.Sprintf("\n\n%v\n\n%s", err, server.helpMessage), http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+	}
+
+	// The database can't be closed while the request is using it
+	handle := server.acquire()
+	defer handle.release()
+
+	if server.registry != nil && strings.HasPrefix(r.URL.Path, "/q/") {
+		registeredQuery, ok := server.registry.lookup(strings.TrimPrefix(r.URL.Path, "/q/"))
+		if !ok {
+			http.Error(w, fmt.Sprintf("\n\nQuery '%s' is not registered\n\n%s", r.URL.Path, server.helpMessage), http.StatusNotFound)
+			return
+		}
+		defer registeredQuery.requests.Done()
+		server.executeQueries(w, r, handle, registeredQuery, boundParams, client, redaction)
+		return
+	}
+
+	if r.URL.Path != "/query" {
+		http.Error(w, server.helpMessage, http.StatusNotFound)
+		return
+	}
+
+	server.executeQueries(w, r, handle, handle.query, boundParams, client, redaction)
+}
+
+// stats are the server's runtime statistics
+type stats struct {
+	Cache     *cacheStats `json:"cache,omitempty"`
+	Coalesced uint64      `json:"coalesced"`
+	Bloom     *bloomStats `json:"bloom,omitempty"`
+	Reloads   uint64      `json:"reloads"`
+	Quotas    *quotaStats `json:"quotas,omitempty"`
+}
+
+func (server *queryServer) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, server.helpMessage, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var response stats
+	response.Coalesced = server.flights.coalescedCount()
+	response.Reloads = atomic.LoadUint64(&server.reloads)
+	if server.cache != nil {
+		cacheStats := server.cache.stats()
+		response.Cache = &cacheStats
+	}
+	if server.keyFilter != nil {
+		bloomStats := server.keyFilter.stats()
+		response.Bloom = &bloomStats
+	}
+	if server.quotas != nil {
+		quotaStats := server.quotas.stats()
+		response.Quotas = &quotaStats
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+
+	answerJSON, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("\n\nError encoding json: %v\n\n%s", err, server.helpMessage), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(answerJSON)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("\n\nError sending json to client: %v\n\n%s", err, server.helpMessage), http.StatusInternalServerError)
+		return
+	}
+}
+
+// quotasHandler serves the state of each client's quotas on the admin API.
+// It isn't in "/stats", which is served on the public port, because it lists the clients.
+func (server *queryServer) quotasHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, server.helpMessage, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+
+	answerJSON, err := json.Marshal(server.quotas.clientStats())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("\n\nError encoding json: %v\n\n%s", err, server.helpMessage), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(answerJSON)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("\n\nError sending json to client: %v\n\n%s", err, server.helpMessage), http.StatusInternalServerError)
+		return
+	}
+}
+
+// preparedQuery is a query that is ready to be served
+type preparedQuery struct {
+	queryString string
+	queryStmt   *sql.Stmt
+	helpMessage string
+	paginator   *paginator      // nil if the query has params
+	readOnly    bool            // Only read-only queries results are cached
+	namedParams map[string]bool // Names of the query's ":name" params
+	paramLayout []string        // Names of the query's params by index, "" if positional, nil if unknown (see bindArgs())
+
+	requests sync.WaitGroup // In-flight requests of a registered query, see registry.lookup()
+}
+
+// prepareQuery prepares queryString on db and builds its help message.
+// Static queries (without params) are also prepared for pagination,
+// ordered by cursorColumn or, if it's empty, by LIMIT/OFFSET.
+func prepareQuery(db *sql.DB, queryString string, queryPath string, serverPort uint, cursorColumn string) (*preparedQuery, error) {
+	queryStmt, err := db.Prepare(queryString)
+	if err != nil {
+		return nil, err
+	}
+
+	query := &preparedQuery{
+		queryString: queryString,
+		queryStmt:   queryStmt,
+		helpMessage: buildHelpMessage("", queryString, queryStmt, queryPath, serverPort),
+		readOnly:    isReadOnlyQuery(queryString),
+		namedParams: queryNamedParams(queryString),
+	}
+
+	queryParamsCount, err := countParams(queryStmt)
+	if layout := queryParamLayout(queryString); err == nil && len(layout) == queryParamsCount {
+		query.paramLayout = layout
+	}
+
+	// Only a SELECT can be wrapped in the paginated SELECT, other statements (e.g. DELETE or PRAGMA) aren't paginated
+	if err == nil && queryParamsCount == 0 && query.readOnly {
+		query.paginator, err = initPaginator(db, queryString, cursorColumn)
+		if err != nil && cursorColumn == "" {
+			// e.g. a query with a statement after it, it's still served, only without pagination
+			log.Printf("Query '%s' is served without pagination: %v\n", queryString, err)
+		} else if err != nil {
+			queryStmt.Close()
+			return nil, err
+		}
+	} else if cursorColumn != "" {
+		queryStmt.Close()
+		return nil, fmt.Errorf("Pagination by --cursor-column is only supported for static read-only queries (SELECT without params)")
+	}
+
+	return query, nil
+}
+
+func (query *preparedQuery) close() {
+	query.queryStmt.Close()
+	if query.paginator != nil {
+		query.paginator.close()
+	}
+}
+
+// executeQueries executes the query once per CSV line of the request body
+// (or once for a GET request) and writes the results as JSON.
+// handle is the database that the request holds, boundParams are
+// the named params that the server sets for the request (see bindParams()),
+// and client is whose quota the lines count against.
+func (server *queryServer) executeQueries(w http.ResponseWriter, r *http.Request, handle *dbHandle, query *preparedQuery, boundParams []sql.NamedArg, client string, redaction *redactionRules) {
+	options := server.options
+	helpMessage := query.helpMessage
+
+	if r.Method != "POST" && r.Method != "GET" {
+		http.Error(w, helpMessage, http.StatusMethodNotAllowed)
+		return
+	}
+
+	timeout, err := requestTimeout(r, options.timeout)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("\n\n%v\n\n%s", err, helpMessage), http.StatusBadRequest)
+		return
+	}
+
+	claimParams := server.jwtVerifier.claimParamNames()
+	err = checkBoundParams(r.URL.Query(), boundParams, claimParams)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("\n\n%v\n\n%s", err, helpMessage), http.StatusBadRequest)
+		return
+	}
+	err = checkClaimParams(query, boundParams, claimParams)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("\n\n%v\n\n%s", err, helpMessage), http.StatusForbidden)
+		return
+	}
+	// Params that the query doesn't have don't change its results
+	boundParams = bindParams(query, boundParams)
+
+	// The request's context is canceled when the client disconnects,
+	// canceling it interrupts the running SQLite statement
+	ctx := r.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Cached results, ETags and the Bloom filter are valid only for the current version of the database
+	var keyFilter *keyFilter
+	if query == handle.query {
+		keyFilter = server.keyFilter
+	}
+
+	var dbVersion string
+	if query.readOnly && (server.cache != nil || keyFilter != nil || r.Method == "GET") {
+		dbVersion, err = server.dataVersion(ctx, handle)
+		if err != nil {
+			if handleContextError(ctx, w, 1, []string{}, timeout, helpMessage) {
+				return
 			}
+			http.Error(w, fmt.Sprintf("\n\nError reading database version: %v\n\n%s", err, helpMessage), http.StatusInternalServerError)
+			return
+		}
+	}
 
-			// Init queryResponse
-			// Set queryResponse.Headers to the query's params (the fields of the csv record)
-			var queryResponse queryResult
-			queryResponse.In = csvRecord
+	var etag string
+	if r.Method == "GET" && dbVersion != "" {
+		etag = computeETag(query.queryString, r.URL.Query(), boundParams, redaction.key(), dbVersion)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			// The response didn't change, no need to execute the query
+			setCachingHeaders(w, etag, options.cacheControl)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
 
-			queryParams := make([]interface{}, len(csvRecord))
-			for i := range csvRecord {
-				queryParams[i] = csvRecord[i]
+	if r.Method == "GET" && (r.URL.Query().Get("limit") != "" || r.URL.Query().Get("cursor") != "") {
+		// Static queries have no params to bind
+		server.quotas.takeLine(client)
+		server.executePage(ctx, w, r, query, timeout, etag, redaction)
+		return
+	}
+
+	// Init fullResponse
+	fullResponse := []queryResult{}
+	totalRows := 0
+
+	var reqCsvReader *csv.Reader
+	if r.Method == "GET" {
+		// Static query
+		reqCsvReader = csv.NewReader(strings.NewReader(""))
+	} else {
+		// Parameterized query
+		body := r.Body
+		if options.limits.maxBodyBytes > 0 {
+			body = http.MaxBytesReader(w, body, options.limits.maxBodyBytes)
+		}
+		reqCsvReader = csv.NewReader(body)
+	}
+	reqCsvReader.FieldsPerRecord = -1
+
+	// Iterate over each query
+	for line := 1; ; line++ {
+		var positionalParams []interface{}
+		var namedParams []sql.NamedArg
+
+		csvRecord, err := reqCsvReader.Read()
+		if r.Method == "POST" {
+			// Parameterized query
+			if err == io.EOF || err == http.ErrBodyReadAfterClose {
+				// EOF || last line is without \n
+				break
+			} else if isBodyTooLarge(err) {
+				http.Error(w, fmt.Sprintf("\n\nRequest body is larger than %d bytes\n\n%s", options.limits.maxBodyBytes, helpMessage), http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				http.Error(w, fmt.Sprintf("\n\nError reading request body: %v\n\n%s", err, helpMessage), http.StatusInternalServerError)
+				return
 			}
 
-			rows, err := queryStmt.Query(queryParams...)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("\n\nError executing query for params %#v: %v\n\n%s", csvRecord, err, helpMessage), http.StatusInternalServerError)
+			if options.limits.maxLines > 0 && line > options.limits.maxLines {
+				http.Error(w, fmt.Sprintf("\n\nRequest body has more than %d lines\n\n%s", options.limits.maxLines, helpMessage), http.StatusRequestEntityTooLarge)
 				return
 			}
-			defer rows.Close()
 
-			// Set queryResponse.Headers to the query's columns
-			// Init queryResponse.Out
-			cols, err := rows.Columns()
+			positionalParams = make([]interface{}, len(csvRecord))
+			for i := range csvRecord {
+				positionalParams[i] = csvRecord[i]
+			}
+		} else {
+			// Static query or params from the URL query string
+			csvRecord, positionalParams, namedParams, err = urlQueryParams(r.URL.Query(), query.namedParams)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("\n\nError reading columns for query with params %#v: %v\n\n%s", csvRecord, err, helpMessage), http.StatusInternalServerError)
+				http.Error(w, fmt.Sprintf("\n\n%v\n\n%s", err, helpMessage), http.StatusBadRequest)
 				return
 			}
+		}
+		queryParams, err := bindArgs(query, positionalParams, append(namedParams, boundParams...))
+		if err != nil {
+			// The params of a GET request are malformed, a bad CSV line fails like the query fails
+			status := http.StatusInternalServerError
+			if r.Method == "GET" {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, fmt.Sprintf("\n\nError executing query for params %#v: %v\n\n%s", csvRecord, err, helpMessage), status)
+			return
+		}
 
-			queryResponse.Headers = cols
-			queryResponse.Out = make([][]interface{}, 0)
-
-			// Iterate over returned rows for this query
-			// Append each row to queryResponse.Out
-			for rows.Next() {
-				row := make([]interface{}, len(cols))
-				pointers := make([]interface{}, len(row))
+		server.quotas.takeLine(client)
 
-				for i := range row {
-					pointers[i] = &row[i]
-				}
+		// Rows left for this line
+		maxRows := options.limits.maxRowsPerLine
+		if options.limits.maxTotalRows > 0 {
+			rowsLeft := options.limits.maxTotalRows - totalRows
+			if rowsLeft <= 0 {
+				maxRows = -1
+			} else if maxRows <= 0 || rowsLeft < maxRows {
+				maxRows = rowsLeft
+			}
+		}
 
-				err = rows.Scan(pointers...)
-				if err != nil {
-					http.Error(w, fmt.Sprintf("\n\nError reading query results for params %#v: %v\n\n%s", csvRecord, err, helpMessage), http.StatusInternalServerError)
+		var queryResponse queryResult
+		if headers, skip := keyFilter.skip(handle, dbVersion, queryParams); skip {
+			// No rows can match, no need to execute the query
+			queryResponse = queryResult{In: csvRecord, Headers: headers, Out: [][]interface{}{}}
+		} else {
+			queryResponse, err = server.runQuery(ctx, dbVersion, query, csvRecord, queryParams, maxRows)
+			if err != nil {
+				if handleContextError(ctx, w, line, csvRecord, timeout, helpMessage) {
 					return
 				}
-
-				queryResponse.Out = append(queryResponse.Out, row)
-			}
-			err = rows.Err()
-			if err != nil {
-				http.Error(w, fmt.Sprintf("\n\nError executing query: %v\n\n%s", err, helpMessage), http.StatusInternalServerError)
+				http.Error(w, fmt.Sprintf("\n\n%v\n\n%s", err, helpMessage), http.StatusInternalServerError)
 				return
 			}
+			keyFilter.setHeaders(queryResponse.Headers)
+		}
+		queryResponse = redaction.apply(queryResponse)
 
-			fullResponse = append(fullResponse, queryResponse)
+		totalRows += len(queryResponse.Out)
+		fullResponse = append(fullResponse, queryResponse)
 
-			if r.Method == "GET" {
-				// Static query - execute only once
-				break
-			}
+		if r.Method == "GET" {
+			// Static query - execute only once
+			break
 		}
+	}
 
-		// Return json
-		w.Header().Add("Content-Type", "application/json")
+	// Return json
+	w.Header().Add("Content-Type", "application/json")
+	if etag != "" {
+		setCachingHeaders(w, etag, options.cacheControl)
+	}
 
-		answerJSON, err := json.Marshal(fullResponse)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("\n\nError encoding json: %v\n\n%s", err, helpMessage), http.StatusInternalServerError)
+	answerJSON, err := json.Marshal(fullResponse)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("\n\nError encoding json: %v\n\n%s", err, helpMessage), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(answerJSON)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("\n\nError sending json to client: %v\n\n%s", err, helpMessage), http.StatusInternalServerError)
+		return
+	}
+}
+
+// executePage executes a static query for one page of results and writes it as JSON
+func (server *queryServer) executePage(ctx context.Context, w http.ResponseWriter, r *http.Request, query *preparedQuery, timeout time.Duration, etag string, redaction *redactionRules) {
+	options := server.options
+
+	if query.paginator == nil {
+		http.Error(w, fmt.Sprintf("\n\nPagination is only supported for static read-only queries (SELECT without params)\n\n%s", query.helpMessage), http.StatusBadRequest)
+		return
+	}
+
+	if query.paginator.offsetStmt == nil && redaction.action(query.paginator.cursorColumn).kind != redactionKeep {
+		// The cursor would reveal the column's value
+		http.Error(w, fmt.Sprintf("\n\nKeyset pagination isn't allowed, cursor column '%s' is redacted\n\n%s", query.paginator.cursorColumn, query.helpMessage), http.StatusForbidden)
+		return
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		http.Error(w, fmt.Sprintf("\n\nInvalid limit '%s': must be a positive integer\n\n%s", r.URL.Query().Get("limit"), query.helpMessage), http.StatusBadRequest)
+		return
+	}
+	if options.limits.maxRowsPerLine > 0 && limit > options.limits.maxRowsPerLine {
+		limit = options.limits.maxRowsPerLine
+	}
+	if options.limits.maxTotalRows > 0 && limit > options.limits.maxTotalRows {
+		limit = options.limits.maxTotalRows
+	}
+
+	queryResponse, err := query.paginator.page(ctx, limit, r.URL.Query().Get("cursor"))
+	if err == errInvalidCursor {
+		http.Error(w, fmt.Sprintf("\n\nInvalid cursor '%s'\n\n%s", r.URL.Query().Get("cursor"), query.helpMessage), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		if handleContextError(ctx, w, 1, []string{}, timeout, query.helpMessage) {
 			return
 		}
+		http.Error(w, fmt.Sprintf("\n\n%v\n\n%s", err, query.helpMessage), http.StatusInternalServerError)
+		return
+	}
+
+	queryResponse = redaction.apply(queryResponse)
+
+	// Return json
+	w.Header().Add("Content-Type", "application/json")
+	if etag != "" {
+		setCachingHeaders(w, etag, options.cacheControl)
+	}
 
-		_, err = w.Write(answerJSON)
+	answerJSON, err := json.Marshal([]queryResult{queryResponse})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("\n\nError encoding json: %v\n\n%s", err, query.helpMessage), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(answerJSON)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("\n\nError sending json to client: %v\n\n%s", err, query.helpMessage), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Query string keys that aren't bound as named params.
+// Keys that the query doesn't have (e.g. a cache buster "_") are ignored.
+var reservedQueryStringKeys = map[string]bool{
+	"p":      true,
+	"limit":  true,
+	"cursor": true,
+}
+
+// urlQueryParams returns the params of a GET request.
+// Each "p" key is a positional param (a question mark in the query string),
+// and any other key that is in queryNamedParams is a named param (":name" in the query string).
+// in is the positional params followed by "name=value" for each named param.
+func urlQueryParams(urlQuery url.Values, queryNamedParams map[string]bool) (in []string, positionalParams []interface{}, namedParams []sql.NamedArg, err error) {
+	in = make([]string, 0)
+	positionalParams = make([]interface{}, 0)
+
+	for _, value := range urlQuery["p"] {
+		in = append(in, value)
+		positionalParams = append(positionalParams, value)
+	}
+
+	names := make([]string, 0, len(urlQuery))
+	for name := range urlQuery {
+		if !reservedQueryStringKeys[name] && queryNamedParams[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if len(urlQuery[name]) > 1 {
+			return nil, nil, nil, fmt.Errorf("Param ':%s' is set more than once", name)
+		}
+		value := urlQuery.Get(name)
+		in = append(in, name+"="+value)
+		namedParams = append(namedParams, sql.Named(name, value))
+	}
+
+	return in, positionalParams, namedParams, nil
+}
+
+// runQuery executes queryStmt with queryParams.
+// If maxRows is positive, at most maxRows rows are returned and the result
+// is marked as truncated if there are more. A negative maxRows means that
+// no rows are left for this query, so only its headers are returned.
+func runQuery(ctx context.Context, queryStmt *sql.Stmt, csvRecord []string, queryParams []interface{}, maxRows int) (queryResult, error) {
+	// Init queryResponse
+	// Set queryResponse.In to the query's params (the fields of the csv record)
+	var queryResponse queryResult
+	queryResponse.In = csvRecord
+
+	rows, err := queryStmt.QueryContext(ctx, queryParams...)
+	if err != nil {
+		return queryResponse, fmt.Errorf("Error executing query for params %#v: %v", csvRecord, err)
+	}
+	defer rows.Close()
+
+	// Set queryResponse.Headers to the query's columns
+	// Init queryResponse.Out
+	cols, err := rows.Columns()
+	if err != nil {
+		return queryResponse, fmt.Errorf("Error reading columns for query with params %#v: %v", csvRecord, err)
+	}
+
+	queryResponse.Headers = cols
+	queryResponse.Out = make([][]interface{}, 0)
+
+	// Iterate over returned rows for this query
+	// Append each row to queryResponse.Out
+	for rows.Next() {
+		if maxRows < 0 || (maxRows > 0 && len(queryResponse.Out) >= maxRows) {
+			queryResponse.Truncated = true
+			break
+		}
+
+		row := make([]interface{}, len(cols))
+		pointers := make([]interface{}, len(row))
+
+		for i := range row {
+			pointers[i] = &row[i]
+		}
+
+		err = rows.Scan(pointers...)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("\n\nError sending json to client: %v\n\n%s", err, helpMessage), http.StatusInternalServerError)
-			return
+			return queryResponse, fmt.Errorf("Error reading query results for params %#v: %v", csvRecord, err)
 		}
-	}, nil
+
+		queryResponse.Out = append(queryResponse.Out, row)
+	}
+	err = rows.Err()
+	if err != nil {
+		return queryResponse, fmt.Errorf("Error executing query: %v", err)
+	}
+
+	return queryResponse, nil
+}
+
+// isBodyTooLarge reports whether err was returned by a http.MaxBytesReader
+// that reached its limit
+func isBodyTooLarge(err error) bool {
+	// http.MaxBytesReader's error isn't exported before Go 1.19
+	return err != nil && strings.HasSuffix(err.Error(), "request body too large")
+}
+
+// requestTimeout returns the timeout of a request.
+// The X-Query-Timeout header can only lower serverTimeout, not extend it.
+func requestTimeout(r *http.Request, serverTimeout time.Duration) (time.Duration, error) {
+	header := r.Header.Get("X-Query-Timeout")
+	if header == "" {
+		return serverTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(header)
+	if err != nil {
+		// Plain numbers are seconds
+		seconds, errFloat := strconv.ParseFloat(header, 64)
+		if errFloat != nil {
+			return 0, fmt.Errorf("Invalid X-Query-Timeout header '%s': %v", header, err)
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("Invalid X-Query-Timeout header '%s': must be positive", header)
+	}
+
+	if serverTimeout > 0 && timeout > serverTimeout {
+		return serverTimeout, nil
+	}
+	return timeout, nil
+}
+
+// handleContextError writes the response for a query that was stopped
+// because ctx is done. It returns false if ctx isn't done.
+func handleContextError(ctx context.Context, w http.ResponseWriter, line int, csvRecord []string, timeout time.Duration, helpMessage string) bool {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		http.Error(w, fmt.Sprintf("\n\nTimeout (%v) executing query for line %d with params %#v\n\n%s", timeout, line, csvRecord, helpMessage), http.StatusGatewayTimeout)
+		return true
+	case context.Canceled:
+		// The client is gone, there's no one to respond to
+		log.Printf("Client disconnected while executing query for line %d with params %#v\n", line, csvRecord)
+		return true
+	}
+	return false
 }
 
-func buildHelpMessage(helpMessage string, queryString string, queryStmt *sql.Stmt, serverPort uint) string {
+func buildHelpMessage(helpMessage string, queryString string, queryStmt *sql.Stmt, queryPath string, serverPort uint) string {
 	helpMessage += fmt.Sprintf(`Query:
 	%s
 
@@ -232,22 +1389,35 @@ func buildHelpMessage(helpMessage string, queryString string, queryStmt *sql.Stm
 	}
 
 	helpMessage += fmt.Sprintf(`Request examples:
-	$ echo -e "$QUERY1_PARAM1,$QUERY1_PARAM2\n$QUERY2_PARAM1,$QUERY2_PARAM2" curl "http://$ADDRESS:%d/query" --data-binary @-
-	$ curl "http://$ADDRESS:%d/query" -d "$PARAM_1,$PARAM_2,...,$PARAM_N"
+	$ echo -e "$QUERY1_PARAM1,$QUERY1_PARAM2\n$QUERY2_PARAM1,$QUERY2_PARAM2" curl "http://$ADDRESS:%d%s" --data-binary @-
+	$ curl "http://$ADDRESS:%d%s" -d "$PARAM_1,$PARAM_2,...,$PARAM_N"
 
-	- Request must be a HTTP POST to "http://$ADDRESS:%d/query".
+	- Request must be a HTTP POST to "http://$ADDRESS:%d%s".
 	- Request body must be a valid CSV.
 	- Request body must not have a CSV header.
 	- Each request body line is a different query.
 	- Each param in a line corresponds to a query param (a question mark in the query string).
 	- Static query (without any query params):
-		- The request must be a HTTP GET to "http://$ADDRESS:%d/query".
+		- The request must be a HTTP GET to "http://$ADDRESS:%d%s".
 		- The query executes only once.
+	- Single query with params in the URL:
+		- The request must be a HTTP GET to "http://$ADDRESS:%d%s?p=$PARAM_1&p=$PARAM_2".
+		- Each "p" is a query param (a question mark in the query string), in order.
+		- Any other key is a named query param, e.g. "?dns=github.com" for ":dns" in the query string.
+	- Request can limit its execution time with an X-Query-Timeout header (e.g. "500ms", "10s" or "2.5").
+		- A timeout responds with HTTP 504, naming the line being executed.
+	- Request body size and lines count may be limited by the server, too large requests respond with HTTP 413.
+	- GET responses of read-only queries have an ETag header.
+		- A request with a matching If-None-Match header responds with HTTP 304, without executing the query.
+	- Static query pagination:
+		- HTTP GET to "http://$ADDRESS:%d%s?limit=$LIMIT" returns the first $LIMIT rows.
+		- The result has a "next" field with the cursor of the next page, it's missing on the last page.
+		- HTTP GET to "http://$ADDRESS:%d%s?limit=$LIMIT&cursor=$NEXT" returns the next page.
 
-`, serverPort, serverPort, serverPort, serverPort)
+`, serverPort, queryPath, serverPort, queryPath, serverPort, queryPath, serverPort, queryPath, serverPort, queryPath, serverPort, queryPath, serverPort, queryPath)
 
 	helpMessage += fmt.Sprintf(`Response example:
-	$ echo -e "github.com\none.one.one.one\ngoogle-public-dns-a.google.com" | curl "http://$ADDRESS:%d/query" --data-binary @-
+	$ echo -e "github.com\none.one.one.one\ngoogle-public-dns-a.google.com" | curl "http://$ADDRESS:%d%s" --data-binary @-
 	[
 		{
 			"in": ["github.com"],
@@ -279,12 +1449,13 @@ func buildHelpMessage(helpMessage string, queryString string, queryStmt *sql.Stm
 		- Has an "in" fields which is an array of the input params (a request body line).
 		- Has an "headers" fields which is an array of headers of the SQL query result.
 		- Has an "out" field which is an array of arrays of results. Each inner array is a result row.
+		- Has a "truncated" field set to true if rows were dropped because of the server's rows limits.
 	- Element #1 is the result of query #1, Element #2 is the result of query #2, and so forth.
 	- Static query (without any query params):
 		- The response JSON has only one element.
 
 For more info visit https://github.com/assafmo/SQLiteQueryServer
-`, serverPort)
+`, serverPort, queryPath)
 
 	return helpMessage
 }
@@ -12,6 +12,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	json "github.com/json-iterator/go"
 )
@@ -611,3 +612,338 @@ func TestCountParamsHandleDBError(t *testing.T) {
 		t.Fatalf(`Should throw a 'syntax error' error: %v`, err)
 	}
 }
+
+func TestMainAdminAddrWithoutRegistry(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	err := cmd([]string{
+		"--db",
+		testDbPath,
+		"--query",
+		"SELECT * FROM ip_dns WHERE dns = ?",
+		"--admin-addr",
+		"127.0.0.1:0",
+	})
+	if err == nil {
+		t.Fatal(`Should throw an error`)
+	}
+	if !strings.Contains(err.Error(), "Must provide --registry param") {
+		t.Fatalf(`Should throw a "Must provide --registry param" error: %v`, err)
+	}
+}
+
+const slowQuery = "WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c WHERE x < CAST(? AS INTEGER)) SELECT count(*) FROM c"
+
+func TestTimeout(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	reqString := "1\n1000000000"
+
+	req := httptest.NewRequest("POST",
+		"http://example.org/query",
+		strings.NewReader(reqString))
+	w := httptest.NewRecorder()
+	queryHandler, err := initQueryHandler(testDbPath, slowQuery, 0, withTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryHandler(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusGatewayTimeout (%d)`, resp.StatusCode, http.StatusGatewayTimeout)
+	}
+
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	respString := string(respBytes)
+
+	if !strings.Contains(respString, "executing query for line 2") {
+		t.Fatalf(`Error string should contain "executing query for line 2": %s`, respString)
+	}
+
+	// The interrupted statement shouldn't hold the connection
+	req = httptest.NewRequest("POST",
+		"http://example.org/query",
+		strings.NewReader("1"))
+	w = httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp = w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestTimeoutHeader(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	req := httptest.NewRequest("POST",
+		"http://example.org/query",
+		strings.NewReader("1000000000"))
+	req.Header.Set("X-Query-Timeout", "50ms")
+	w := httptest.NewRecorder()
+	queryHandler, err := initQueryHandler(testDbPath, slowQuery, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryHandler(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusGatewayTimeout (%d)`, resp.StatusCode, http.StatusGatewayTimeout)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	tests := []struct {
+		header        string
+		serverTimeout time.Duration
+		expected      time.Duration
+		expectErr     bool
+	}{
+		{"", 0, 0, false},
+		{"", time.Second, time.Second, false},
+		{"500ms", 0, 500 * time.Millisecond, false},
+		{"2.5", 0, 2500 * time.Millisecond, false},
+		{"1m", time.Second, time.Second, false},
+		{"-1s", 0, 0, true},
+		{"banana", 0, 0, true},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.org/query", nil)
+		if test.header != "" {
+			req.Header.Set("X-Query-Timeout", test.header)
+		}
+
+		timeout, err := requestTimeout(req, test.serverTimeout)
+		if test.expectErr {
+			if err == nil {
+				t.Fatalf(`Header "%s" should throw an error`, test.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if timeout != test.expected {
+			t.Fatalf(`Header "%s" with server timeout %v: timeout (%v) != %v`, test.header, test.serverTimeout, timeout, test.expected)
+		}
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	reqString := "github.com\none.one.one.one\ngoogle-public-dns-a.google.com"
+
+	req := httptest.NewRequest("POST",
+		"http://example.org/query",
+		strings.NewReader(reqString))
+	w := httptest.NewRecorder()
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withLimits(limits{maxBodyBytes: 20}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryHandler(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusRequestEntityTooLarge (%d)`, resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestMaxLines(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	reqString := "github.com\none.one.one.one\ngoogle-public-dns-a.google.com"
+
+	req := httptest.NewRequest("POST",
+		"http://example.org/query",
+		strings.NewReader(reqString))
+	w := httptest.NewRecorder()
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withLimits(limits{maxLines: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryHandler(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusRequestEntityTooLarge (%d)`, resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestMaxRows(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	reqString := "github.com\none.one.one.one\ngoogle-public-dns-a.google.com"
+
+	req := httptest.NewRequest("POST",
+		"http://example.org/query",
+		strings.NewReader(reqString))
+	w := httptest.NewRecorder()
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withLimits(limits{maxRowsPerLine: 1, maxTotalRows: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryHandler(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+	}
+
+	var fullResponse []queryResult
+	decoder := json.NewDecoder(resp.Body)
+	err = decoder.Decode(&fullResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedResponse := []queryResult{
+		{
+			Out: [][]interface{}{
+				{"192.30.253.112", "github.com"},
+			}},
+		{
+			Out: [][]interface{}{
+				{"1.1.1.1", "one.one.one.one"},
+			}},
+		{
+			Out: [][]interface{}{}},
+	}
+
+	compare(t, fullResponse, expectedResponse)
+
+	for i, truncated := range []bool{true, false, true} {
+		if fullResponse[i].Truncated != truncated {
+			t.Fatalf(`fullResponse[%d].Truncated != %v`, i, truncated)
+		}
+	}
+	if len(fullResponse[2].Headers) != 2 {
+		t.Fatal(`len(fullResponse[2].Headers) != 2`)
+	}
+}
+
+func TestGetWithParams(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tests := []struct {
+		queryString string
+		url         string
+		in          []string
+	}{
+		{"SELECT * FROM ip_dns WHERE dns = ? AND ip = ?", "http://example.org/query?p=github.com&p=192.30.253.112", []string{"github.com", "192.30.253.112"}},
+		{"SELECT * FROM ip_dns WHERE dns = :dns AND ip = :ip", "http://example.org/query?ip=192.30.253.112&dns=github.com", []string{"dns=github.com", "ip=192.30.253.112"}},
+		{"SELECT * FROM ip_dns WHERE dns = ? AND ip = :ip", "http://example.org/query?ip=192.30.253.112&p=github.com", []string{"github.com", "ip=192.30.253.112"}},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		w := httptest.NewRecorder()
+		queryHandler, err := initQueryHandler(testDbPath, test.queryString, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queryHandler(w, req)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf(`%s: resp.StatusCode (%d) != http.StatusOK (%d)`, test.url, resp.StatusCode, http.StatusOK)
+		}
+
+		var fullResponse []queryResult
+		decoder := json.NewDecoder(resp.Body)
+		err = decoder.Decode(&fullResponse)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedResponse := []queryResult{
+			{
+				Out: [][]interface{}{
+					{"192.30.253.112", "github.com"},
+				}},
+		}
+
+		compare(t, fullResponse, expectedResponse)
+
+		if strings.Join(fullResponse[0].In, ",") != strings.Join(test.in, ",") {
+			t.Fatalf(`%s: fullResponse[0].In (%v) != %v`, test.url, fullResponse[0].In, test.in)
+		}
+	}
+}
+
+func TestGetWithBadParamsCount(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	req := httptest.NewRequest("GET", "http://example.org/query?p=github.com&p=1", nil)
+	w := httptest.NewRecorder()
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryHandler(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusBadRequest (%d)`, resp.StatusCode, http.StatusBadRequest)
+	}
+
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(respBytes), "sql: expected 1 arguments, got 2") {
+		t.Fatal(`Error string should contain "sql: expected 1 arguments, got 2"`)
+	}
+}
+
+func TestGetWithUnknownOrMalformedParams(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	for _, test := range []struct {
+		queryString string
+		url         string
+		statusCode  int
+	}{
+		{"SELECT * FROM ip_dns", "http://example.org/query?_=12345", http.StatusOK},
+		{"SELECT * FROM ip_dns", "http://example.org/query?foo=1", http.StatusOK},
+		{"SELECT * FROM ip_dns WHERE dns = :dns", "http://example.org/query?dns=github.com&_=12345", http.StatusOK},
+		{"SELECT * FROM ip_dns WHERE dns = :dns", "http://example.org/query?dns=github.com&dns=example.org", http.StatusBadRequest},
+		{"SELECT * FROM ip_dns WHERE dns = :dns", "http://example.org/query?_=12345", http.StatusBadRequest},
+		{"SELECT * FROM ip_dns WHERE dns = ?", "http://example.org/query?dns=github.com", http.StatusBadRequest},
+	} {
+		queryHandler, err := initQueryHandler(testDbPath, test.queryString, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest("GET", test.url, nil))
+
+		if w.Result().StatusCode != test.statusCode {
+			t.Fatalf(`%s: resp.StatusCode (%d) != %d`, test.url, w.Result().StatusCode, test.statusCode)
+		}
+	}
+}
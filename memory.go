@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Each in-memory database gets a unique name, so they don't share their cache
+var inMemoryDBCount uint64
+
+// openInMemoryDB copies the database file at dbPath into a new in-memory database,
+// opened with the SQLite driver driverName
+func openInMemoryDB(driverName string, dbPath string, openMode string) (*sql.DB, error) {
+	name := fmt.Sprintf("file:sqlitequeryserver_%d?mode=memory&cache=shared", atomic.AddUint64(&inMemoryDBCount, 1))
+
+	db, err := sql.Open(driverName, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The in-memory database lives as long as its connection
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(0)
+
+	err = loadIntoMemory(context.Background(), db, dbPath, openMode)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// loadIntoMemory replaces the content of the in-memory database db
+// with the content of the database file at dbPath, using the SQLite backup API.
+// The file is opened read-only, or immutable if openMode is immutable.
+// A compressed file is decompressed into a temp file, which is removed after loading it.
+// Queries wait for the connection while it is loading.
+func loadIntoMemory(ctx context.Context, db *sql.DB, dbPath string, openMode string) error {
+	start := time.Now()
+
+	srcPath := dbPath
+	if compressionFormat(dbPath) != "" {
+		var err error
+		srcPath, err = decompressDatabase(dbPath)
+		if err != nil {
+			return err
+		}
+		defer removeDatabaseFile(srcPath)
+
+		// Nothing else uses the temp file
+		openMode = openModeImmutable
+	}
+
+	srcDSN := fmt.Sprintf("file:%s?mode=ro", srcPath)
+	if openMode == openModeImmutable {
+		srcDSN, _ = databaseDSN(srcPath, openModeImmutable)
+	}
+
+	srcDB, err := sql.Open("sqlite3", srcDSN)
+	if err != nil {
+		return err
+	}
+	defer srcDB.Close()
+
+	srcConn, err := srcDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("Cannot open database file '%s': %v", dbPath, err)
+	}
+	defer srcConn.Close()
+
+	destConn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	err = destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			backup, err := destDriverConn.(*sqlite3.SQLiteConn).Backup("main", srcDriverConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+
+			for {
+				done, err := backup.Step(-1)
+				if err != nil {
+					backup.Close()
+					return err
+				}
+				if done {
+					break
+				}
+
+				// The source is locked by a writer, retry
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			return backup.Close()
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("Cannot load database file '%s' into memory: %v", dbPath, err)
+	}
+
+	log.Printf("Loaded database file '%s' into memory in %v\n", dbPath, time.Since(start))
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	json "github.com/json-iterator/go"
+)
+
+func TestInMemory(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withInMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST",
+		"http://example.org/query",
+		strings.NewReader("github.com\none.one.one.one"))
+	w := httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+	}
+
+	var fullResponse []queryResult
+	err = json.NewDecoder(resp.Body).Decode(&fullResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedResponse := []queryResult{
+		{
+			Out: [][]interface{}{
+				{"192.30.253.112", "github.com"},
+				{"192.30.253.113", "github.com"},
+			}},
+		{
+			Out: [][]interface{}{
+				{"1.1.1.1", "one.one.one.one"},
+			}},
+	}
+
+	compare(t, fullResponse, expectedResponse)
+}
+
+func TestInMemoryReload(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	reloadSignal := make(chan os.Signal, 1)
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns", 0, withInMemory(), withReload(0, 0, reloadSignal))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() *http.Response {
+		req := httptest.NewRequest("GET", "http://example.org/query", nil)
+		w := httptest.NewRecorder()
+		queryHandler(w, req)
+		return w.Result()
+	}
+
+	resp := get()
+	defer resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+
+	reloadSignal <- os.Interrupt
+
+	deadline := time.Now().Add(5 * time.Second)
+	for getStats(t, queryHandler).Reloads != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal(`The database should have been reloaded`)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp = get()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+	}
+	if resp.Header.Get("ETag") == etag {
+		t.Fatal(`A reloaded database should have a different ETag`)
+	}
+}
+
+func TestInMemoryReloadColumnsChanged(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbPath := copyTestDb(t, tmpDir)
+
+	server, err := newQueryServer(dbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withInMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replaceDb(t, dbPath,
+		"CREATE TABLE ip_dns (dns TEXT, ip TEXT)",
+		"INSERT INTO ip_dns VALUES ('github.com', '140.82.121.4')")
+
+	err = server.reload()
+	if err == nil || !strings.Contains(err.Error(), "Columns of query") {
+		t.Fatalf(`Should fail with a columns error when the query's columns changed: %v`, err)
+	}
+
+	replaceDb(t, dbPath, "CREATE TABLE banana (x)")
+
+	err = server.reload()
+	if err == nil {
+		t.Fatal(`Should fail when the query doesn't prepare`)
+	}
+
+	// Still served from the previously loaded database
+	if len(queryGithub(t, server)[0].Out) != 2 {
+		t.Fatal(`The previously loaded database should still be served`)
+	}
+
+	replaceDb(t, dbPath,
+		"CREATE TABLE ip_dns (ip TEXT, dns TEXT)",
+		"INSERT INTO ip_dns VALUES ('140.82.121.4', 'github.com')")
+
+	err = server.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queryGithub(t, server)[0].Out) != 1 {
+		t.Fatal(`The reloaded database should be served`)
+	}
+}
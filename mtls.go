@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	json "github.com/json-iterator/go"
+)
+
+// loadClientCAs loads the PEM certificates of the CAs that issue client certificates
+func loadClientCAs(clientCAPath string) (*x509.CertPool, error) {
+	pemCerts, err := ioutil.ReadFile(clientCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load client CA: %v", err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(pemCerts) {
+		return nil, fmt.Errorf("Cannot load client CA '%s': no PEM certificates", clientCAPath)
+	}
+
+	return clientCAs, nil
+}
+
+// clientIdentity returns the identity of the request's verified client certificate:
+// its CN, or if it's empty its first URI, DNS or email SAN.
+// It's "" if the client didn't present a certificate.
+func clientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+
+	cert := r.TLS.PeerCertificates[0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// clientACL maps client identities to the endpoints they may call, e.g.
+//
+//	{"billing": ["/query", "/q/<hash>"], "ops": ["*"], "*": ["/stats"]}
+//
+// An endpoint ending with "/" allows all the endpoints under it (e.g. "/q/" or "/admin/"),
+// and the "*" identity applies to all identities.
+type clientACL map[string][]string
+
+func loadClientACL(clientACLPath string) (clientACL, error) {
+	aclJSON, err := ioutil.ReadFile(clientACLPath)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load client ACL: %v", err)
+	}
+
+	var acl clientACL
+	err = json.Unmarshal(aclJSON, &acl)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load client ACL '%s': %v", clientACLPath, err)
+	}
+
+	return acl, nil
+}
+
+// allows reports whether identity may call the endpoint at path
+func (acl clientACL) allows(identity string, path string) bool {
+	return endpointAllowed(acl[identity], path) || endpointAllowed(acl["*"], path)
+}
+
+// endpointAllowed reports whether endpoints allow the endpoint at path,
+// an endpoint ending with "/" allows all the endpoints under it and "*" allows all
+func endpointAllowed(endpoints []string, path string) bool {
+	for _, endpoint := range endpoints {
+		if endpoint == "*" || endpoint == path || (strings.HasSuffix(endpoint, "/") && strings.HasPrefix(path, endpoint)) {
+			return true
+		}
+	}
+	return false
+}
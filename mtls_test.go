@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClientIdentity(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.org/billing")
+
+	for _, test := range []struct {
+		cert     *x509.Certificate
+		identity string
+	}{
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "billing"}, DNSNames: []string{"billing.example.org"}}, "billing"},
+		{&x509.Certificate{URIs: []*url.URL{spiffe}, DNSNames: []string{"billing.example.org"}}, "spiffe://example.org/billing"},
+		{&x509.Certificate{DNSNames: []string{"billing.example.org"}}, "billing.example.org"},
+		{&x509.Certificate{EmailAddresses: []string{"billing@example.org"}}, "billing@example.org"},
+	} {
+		req := httptest.NewRequest("GET", "https://example.org/query", nil)
+		req.TLS.PeerCertificates = []*x509.Certificate{test.cert}
+
+		if clientIdentity(req) != test.identity {
+			t.Fatalf(`clientIdentity() (%s) != %s`, clientIdentity(req), test.identity)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "http://example.org/query", nil)
+	if clientIdentity(req) != "" {
+		t.Fatalf(`clientIdentity() (%s) should be empty without a client certificate`, clientIdentity(req))
+	}
+}
+
+func TestClientACL(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	aclPath := filepath.Join(tmpDir, "acl.json")
+	err = ioutil.WriteFile(aclPath, []byte(`{"billing": ["/query"], "ops": ["*"], "*": ["/stats"]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withClientACL(aclPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		identity   string
+		path       string
+		statusCode int
+	}{
+		{"billing", "/query?p=github.com", http.StatusOK},
+		{"billing", "/stats", http.StatusOK},
+		{"ops", "/query?p=github.com", http.StatusOK},
+		{"marketing", "/stats", http.StatusOK},
+		{"marketing", "/query?p=github.com", http.StatusForbidden},
+		{"", "/stats", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("GET", "https://example.org"+test.path, nil)
+		if test.identity != "" {
+			req.TLS.PeerCertificates = []*x509.Certificate{{Subject: pkix.Name{CommonName: test.identity}}}
+		}
+		w := httptest.NewRecorder()
+		queryHandler(w, req)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		if resp.StatusCode != test.statusCode {
+			t.Fatalf(`%s %s: resp.StatusCode (%d) != %d`, test.identity, test.path, resp.StatusCode, test.statusCode)
+		}
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	logs := &bytes.Buffer{}
+	log.SetOutput(logs)
+
+	tmpDir, err := ioutil.TempDir("", "mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	serverCert := writeTestCert(t, filepath.Join(tmpDir, "server.pem"), filepath.Join(tmpDir, "server.key"), "server")
+	writeTestCert(t, filepath.Join(tmpDir, "client.pem"), filepath.Join(tmpDir, "client.key"), "billing")
+
+	reloader, err := newCertReloader(filepath.Join(tmpDir, "server.pem"), filepath.Join(tmpDir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs, err := loadClientCAs(filepath.Join(tmpDir, "client.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(tmpDir, "client.pem"), filepath.Join(tmpDir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := newQueryServer(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withOpenMode(openModeReadOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(server, listener, nil, reloader.tlsConfig(tls.VersionTLS12, clientCAs), time.Second, stop)
+	}()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(serverCert)
+
+	// Without a client certificate
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: rootCAs}}}
+	resp, err := client.Post("https://"+listener.Addr().String()+"/query", "text/csv", strings.NewReader("github.com"))
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal(`A client without a certificate shouldn't be served`)
+	}
+
+	// With a client certificate
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: rootCAs, Certificates: []tls.Certificate{clientCert}}}}
+	resp, err = client.Post("https://"+listener.Addr().String()+"/query", "text/csv", strings.NewReader("github.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+	}
+
+	stop <- syscall.SIGTERM
+	err = <-served
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(logs.String(), " billing POST /query 200 ") {
+		t.Fatalf(`The access log should have the client's identity: %s`, logs.String())
+	}
+}
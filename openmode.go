@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Modes of opening the database, see --open-mode
+const (
+	openModeReadWrite = "rw"
+	openModeReadOnly  = "ro"
+	openModeImmutable = "immutable"
+)
+
+// databaseDSN returns the DSN of the database file at dbPath for openMode
+func databaseDSN(dbPath string, openMode string) (string, error) {
+	switch openMode {
+	case openModeReadWrite, "":
+		return fmt.Sprintf("file:%s?mode=rw&cache=shared&_journal_mode=WAL", dbPath), nil
+	case openModeReadOnly:
+		// Not in the shared cache, which would share the connections of read-write databases
+		return fmt.Sprintf("file:%s?mode=ro", dbPath), nil
+	case openModeImmutable:
+		// No locking and no change detection, for files that can't change (e.g. on read-only media)
+		return fmt.Sprintf("file:%s?mode=ro&immutable=1", dbPath), nil
+	}
+	return "", fmt.Errorf("Unknown open mode '%s', must be one of: rw, ro, immutable", openMode)
+}
+
+// openDatabaseFile opens the database file at dbPath with openMode,
+// using the SQLite driver driverName
+func openDatabaseFile(driverName string, dbPath string, openMode string) (*sql.DB, error) {
+	dsn, err := databaseDSN(dbPath, openMode)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkOpenMode(dbPath, openMode)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(1)
+
+	return db, nil
+}
+
+// checkOpenMode makes sure that the database file at dbPath can be served with openMode,
+// so that the server doesn't fail on the first query or leave stray "-wal"/"-shm" files
+func checkOpenMode(dbPath string, openMode string) error {
+	dir := filepath.Dir(dbPath)
+
+	switch openMode {
+	case openModeReadWrite, "":
+		if !isDirWritable(dir) {
+			return fmt.Errorf("Cannot use WAL mode, directory '%s' isn't writable (use --open-mode=ro or --open-mode=immutable)", dir)
+		}
+	case openModeReadOnly:
+		wal, err := isWALDatabase(dbPath)
+		if err != nil {
+			return err
+		}
+		if wal && !isDirWritable(dir) {
+			return fmt.Errorf("Cannot read WAL mode database '%s', directory '%s' isn't writable (use --open-mode=immutable)", dbPath, dir)
+		}
+	}
+
+	return nil
+}
+
+// isDirWritable reports whether files can be created in dir,
+// which also catches read-only mounts
+func isDirWritable(dir string) bool {
+	file, err := ioutil.TempFile(dir, ".sqlitequeryserver-")
+	if err != nil {
+		return false
+	}
+
+	file.Close()
+	os.Remove(file.Name())
+	return true
+}
+
+// isWALDatabase reports whether the database file at dbPath is in WAL mode,
+// according to the file format versions in its header
+func isWALDatabase(dbPath string) (bool, error) {
+	file, err := os.Open(dbPath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 20)
+	_, err = io.ReadFull(file, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// An empty database
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return header[18] == 2 && header[19] == 2, nil
+}
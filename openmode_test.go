@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func copyTestDb(t *testing.T, dir string) string {
+	content, err := ioutil.ReadFile(testDbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbPath := filepath.Join(dir, "ip_dns.db")
+	err = ioutil.WriteFile(dbPath, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dbPath
+}
+
+func TestOpenModeImmutable(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "openmode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbPath := copyTestDb(t, tmpDir)
+
+	queryHandler, err := initQueryHandler(dbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withOpenMode(openModeImmutable))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "http://example.org/query", strings.NewReader("github.com"))
+	w := httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+	}
+
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if _, err := os.Stat(dbPath + suffix); !os.IsNotExist(err) {
+			t.Fatalf(`Immutable mode shouldn't create '%s%s'`, dbPath, suffix)
+		}
+	}
+}
+
+func TestOpenModeReadOnly(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	queryHandler, err := initQueryHandler(testDbPath, "DELETE FROM ip_dns WHERE dns = ?", 0, withOpenMode(openModeReadOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "http://example.org/query", strings.NewReader("github.com"))
+	w := httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusInternalServerError (%d)`, resp.StatusCode, http.StatusInternalServerError)
+	}
+}
+
+func TestUnknownOpenMode(t *testing.T) {
+	_, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withOpenMode("banana"))
+	if err == nil {
+		t.Fatal(`Should fail with an unknown open mode`)
+	}
+}
+
+func TestIsWALDatabase(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "openmode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, journalMode := range []string{"DELETE", "WAL"} {
+		dbPath := filepath.Join(tmpDir, journalMode+".db")
+
+		db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_journal_mode=%s", dbPath, journalMode))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("CREATE TABLE x (y)")
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wal, err := isWALDatabase(dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wal != (journalMode == "WAL") {
+			t.Fatalf(`isWALDatabase() (%v) is wrong for journal mode %s`, wal, journalMode)
+		}
+	}
+}
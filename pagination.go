@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	json "github.com/json-iterator/go"
+)
+
+// paginator pages through the results of a static query (without params).
+// If it has a cursor column it uses keyset pagination on it,
+// otherwise it falls back to LIMIT/OFFSET.
+type paginator struct {
+	cursorColumn string
+
+	firstPageStmt *sql.Stmt // Keyset pagination: first page
+	nextPageStmt  *sql.Stmt // Keyset pagination: pages after the cursor key
+	offsetStmt    *sql.Stmt // LIMIT/OFFSET pagination
+}
+
+// pageCursor is the decoded opaque cursor of the next page
+type pageCursor struct {
+	Key    interface{} `json:"k,omitempty"`
+	Offset int64       `json:"o,omitempty"`
+}
+
+func initPaginator(db *sql.DB, queryString string, cursorColumn string) (*paginator, error) {
+	// The query is used as a subquery, so it mustn't end with a semicolon,
+	// and it's closed on a new line in case it ends with a "--" comment
+	subquery := strings.TrimRight(strings.TrimSpace(queryString), "; \t\n") + "\n"
+
+	p := &paginator{cursorColumn: cursorColumn}
+
+	if cursorColumn == "" {
+		offsetStmt, err := db.Prepare(fmt.Sprintf("SELECT * FROM (%s) LIMIT ? OFFSET ?", subquery))
+		if err != nil {
+			return nil, fmt.Errorf("Cannot prepare query for pagination: %v", err)
+		}
+		p.offsetStmt = offsetStmt
+		return p, nil
+	}
+
+	quotedColumn := quoteIdentifier(cursorColumn)
+
+	firstPageStmt, err := db.Prepare(fmt.Sprintf("SELECT * FROM (%s) ORDER BY %s LIMIT ?", subquery, quotedColumn))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot prepare query for pagination by column '%s': %v", cursorColumn, err)
+	}
+
+	nextPageStmt, err := db.Prepare(fmt.Sprintf("SELECT * FROM (%s) WHERE %s > ? ORDER BY %s LIMIT ?", subquery, quotedColumn, quotedColumn))
+	if err != nil {
+		firstPageStmt.Close()
+		return nil, fmt.Errorf("Cannot prepare query for pagination by column '%s': %v", cursorColumn, err)
+	}
+
+	p.firstPageStmt = firstPageStmt
+	p.nextPageStmt = nextPageStmt
+
+	// SQLite treats a double quoted identifier that doesn't exist as a string literal,
+	// so make sure that cursorColumn is really one of the query's columns
+	rows, err := firstPageStmt.Query(0)
+	if err != nil {
+		p.close()
+		return nil, fmt.Errorf("Cannot prepare query for pagination by column '%s': %v", cursorColumn, err)
+	}
+	cols, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		p.close()
+		return nil, fmt.Errorf("Cannot prepare query for pagination by column '%s': %v", cursorColumn, err)
+	}
+	found := false
+	for _, col := range cols {
+		if col == cursorColumn {
+			found = true
+			break
+		}
+	}
+	if !found {
+		p.close()
+		return nil, fmt.Errorf("Cannot prepare query for pagination by column '%s': no such column in the query results %v", cursorColumn, cols)
+	}
+
+	// A page starts after the previous page's last key, so rows with the same key
+	// as the last row of a page would be skipped, and rows with a NULL key never reached
+	var uniqueNotNull bool
+	err = db.QueryRow(fmt.Sprintf("SELECT count(*) = count(%s) AND count(%s) = count(DISTINCT %s) FROM (%s)", quotedColumn, quotedColumn, quotedColumn, subquery)).Scan(&uniqueNotNull)
+	if err != nil {
+		p.close()
+		return nil, fmt.Errorf("Cannot prepare query for pagination by column '%s': %v", cursorColumn, err)
+	}
+	if !uniqueNotNull {
+		p.close()
+		return nil, fmt.Errorf("Cannot prepare query for pagination by column '%s': its values must be unique and not NULL", cursorColumn)
+	}
+
+	return p, nil
+}
+
+func (p *paginator) close() {
+	for _, stmt := range []*sql.Stmt{p.firstPageStmt, p.nextPageStmt, p.offsetStmt} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+}
+
+// page returns up to limit rows after cursor (an empty cursor is the first page).
+// queryResponse.Next is the cursor of the next page, empty if this is the last page.
+func (p *paginator) page(ctx context.Context, limit int, cursor string) (queryResult, error) {
+	var decodedCursor pageCursor
+	if cursor != "" {
+		cursorBytes, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err == nil {
+			// Keep integer keys exact instead of decoding them as float64
+			decoder := json.NewDecoder(bytes.NewReader(cursorBytes))
+			decoder.UseNumber()
+			err = decoder.Decode(&decodedCursor)
+		}
+		if err != nil {
+			return queryResult{}, errInvalidCursor
+		}
+	}
+
+	// Query one more row than needed to know if there's a next page
+	if limit > maxInt-1 {
+		limit = maxInt - 1
+	}
+	var queryResponse queryResult
+	var err error
+	switch {
+	case p.offsetStmt != nil:
+		queryResponse, err = runQuery(ctx, p.offsetStmt, []string{}, []interface{}{limit + 1, decodedCursor.Offset}, limit+1)
+	case decodedCursor.Key == nil:
+		queryResponse, err = runQuery(ctx, p.firstPageStmt, []string{}, []interface{}{limit + 1}, limit+1)
+	default:
+		queryResponse, err = runQuery(ctx, p.nextPageStmt, []string{}, []interface{}{cursorKey(decodedCursor.Key), limit + 1}, limit+1)
+	}
+	if err != nil {
+		return queryResponse, err
+	}
+	queryResponse.Truncated = false
+
+	if len(queryResponse.Out) <= limit {
+		// Last page
+		return queryResponse, nil
+	}
+	queryResponse.Out = queryResponse.Out[:limit]
+
+	var nextCursor pageCursor
+	if p.offsetStmt != nil {
+		nextCursor.Offset = decodedCursor.Offset + int64(limit)
+	} else {
+		lastRow := queryResponse.Out[limit-1]
+		for i, col := range queryResponse.Headers {
+			if col == p.cursorColumn {
+				nextCursor.Key = lastRow[i]
+				if keyBytes, ok := nextCursor.Key.([]byte); ok {
+					nextCursor.Key = string(keyBytes)
+				}
+				break
+			}
+		}
+		if nextCursor.Key == nil {
+			return queryResponse, fmt.Errorf("Cursor column '%s' is missing or NULL in the query results", p.cursorColumn)
+		}
+	}
+
+	cursorBytes, err := json.Marshal(nextCursor)
+	if err != nil {
+		return queryResponse, err
+	}
+	queryResponse.Next = base64.RawURLEncoding.EncodeToString(cursorBytes)
+
+	return queryResponse, nil
+}
+
+var errInvalidCursor = fmt.Errorf("Invalid cursor")
+
+// maxInt is the largest int (math.MaxInt is only in Go 1.17)
+const maxInt = int(^uint(0) >> 1)
+
+// jsonNumber is a number decoded with UseNumber()
+type jsonNumber interface {
+	Int64() (int64, error)
+	Float64() (float64, error)
+	String() string
+}
+
+// cursorKey converts a key decoded from a cursor back to an SQLite value
+func cursorKey(key interface{}) interface{} {
+	number, ok := key.(jsonNumber)
+	if !ok {
+		return key
+	}
+	if i, err := number.Int64(); err == nil {
+		return i
+	}
+	if f, err := number.Float64(); err == nil {
+		return f
+	}
+	return number.String()
+}
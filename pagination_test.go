@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	json "github.com/json-iterator/go"
+)
+
+func getPage(t *testing.T, queryHandler func(w http.ResponseWriter, r *http.Request), limit string, cursor string) (int, []queryResult) {
+	params := url.Values{}
+	params.Set("limit", limit)
+	if cursor != "" {
+		params.Set("cursor", cursor)
+	}
+
+	req := httptest.NewRequest("GET",
+		"http://example.org/query?"+params.Encode(),
+		nil)
+	w := httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+
+	var fullResponse []queryResult
+	err := json.NewDecoder(resp.Body).Decode(&fullResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fullResponse) != 1 {
+		t.Fatal(`len(fullResponse) != 1`)
+	}
+
+	return resp.StatusCode, fullResponse
+}
+
+func TestPaginationOffset(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns;", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, firstPage := getPage(t, queryHandler, "3", "")
+	compare(t, firstPage, []queryResult{
+		{
+			Out: [][]interface{}{
+				{"1.1.1.1", "one.one.one.one"},
+				{"8.8.8.8", "google-public-dns-a.google.com"},
+				{"192.30.253.112", "github.com"},
+			}},
+	})
+	if firstPage[0].Next == "" {
+		t.Fatal(`firstPage[0].Next should not be empty`)
+	}
+
+	_, lastPage := getPage(t, queryHandler, "3", firstPage[0].Next)
+	compare(t, lastPage, []queryResult{
+		{
+			Out: [][]interface{}{
+				{"192.30.253.113", "github.com"},
+			}},
+	})
+	if lastPage[0].Next != "" {
+		t.Fatal(`lastPage[0].Next should be empty`)
+	}
+}
+
+func TestPaginationKeyset(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns", 0, withCursorColumn("ip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pages [][][]interface{}
+	cursor := ""
+	for {
+		_, page := getPage(t, queryHandler, "2", cursor)
+		pages = append(pages, page[0].Out)
+
+		cursor = page[0].Next
+		if cursor == "" {
+			break
+		}
+	}
+
+	expectedPages := [][][]interface{}{
+		{
+			{"1.1.1.1", "one.one.one.one"},
+			{"192.30.253.112", "github.com"},
+		},
+		{
+			{"192.30.253.113", "github.com"},
+			{"8.8.8.8", "google-public-dns-a.google.com"},
+		},
+	}
+
+	if len(pages) != len(expectedPages) {
+		t.Fatalf(`len(pages) (%d) != len(expectedPages) (%d)`, len(pages), len(expectedPages))
+	}
+	for i := range expectedPages {
+		compare(t, []queryResult{{Out: pages[i]}}, []queryResult{{Out: expectedPages[i]}})
+	}
+}
+
+func TestPaginationBadRequests(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct{ limit, cursor string }{
+		{"0", ""},
+		{"banana", ""},
+		{"2", "banana"},
+	} {
+		statusCode, _ := getPage(t, queryHandler, test.limit, test.cursor)
+		if statusCode != http.StatusBadRequest {
+			t.Fatalf(`limit "%s" cursor "%s": statusCode (%d) != http.StatusBadRequest (%d)`, test.limit, test.cursor, statusCode, http.StatusBadRequest)
+		}
+	}
+
+	queryHandler, err = initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statusCode, _ := getPage(t, queryHandler, "2", "")
+	if statusCode != http.StatusBadRequest {
+		t.Fatalf(`statusCode (%d) != http.StatusBadRequest (%d)`, statusCode, http.StatusBadRequest)
+	}
+}
+
+func TestPaginationMaxLimit(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	for _, opt := range []handlerOption{withCursorColumn("ip"), withLimits(limits{})} {
+		queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns", 0, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// limit+1 mustn't overflow into a negative LIMIT
+		statusCode, page := getPage(t, queryHandler, "9223372036854775807", "")
+		if statusCode != http.StatusOK {
+			t.Fatalf(`statusCode (%d) != http.StatusOK (%d)`, statusCode, http.StatusOK)
+		}
+		if len(page) != 1 || len(page[0].Out) != 4 || page[0].Next != "" {
+			t.Fatalf(`page (%v) should have all 4 rows and no next page`, page)
+		}
+	}
+}
+
+func TestPaginationNotSelect(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	// Static statements that can't be wrapped in a paginated SELECT are still served, without pagination
+	_, err := initQueryHandler(testDbPath, "DELETE FROM ip_dns WHERE 0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryHandler, err := initQueryHandler(testDbPath, "PRAGMA table_info(ip_dns)", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest("GET", "http://example.org/query", nil))
+	var fullResponse []queryResult
+	err = json.NewDecoder(w.Result().Body).Decode(&fullResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fullResponse) != 1 || len(fullResponse[0].Out) != 2 {
+		t.Fatalf(`fullResponse (%v) should have the 2 columns of ip_dns`, fullResponse)
+	}
+
+	statusCode, _ := getPage(t, queryHandler, "1", "")
+	if statusCode != http.StatusBadRequest {
+		t.Fatalf(`statusCode (%d) != http.StatusBadRequest (%d)`, statusCode, http.StatusBadRequest)
+	}
+
+	_, err = initQueryHandler(testDbPath, "PRAGMA table_info(ip_dns)", 0, withCursorColumn("cid"))
+	if err == nil {
+		t.Fatal(`--cursor-column should fail for a query that isn't a SELECT`)
+	}
+}
+
+func TestPaginationTrailingComment(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns -- all rows", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, page := getPage(t, queryHandler, "3", "")
+	if len(page[0].Out) != 3 || page[0].Next == "" {
+		t.Fatalf(`page (%v) should have 3 rows and a next page`, page)
+	}
+
+	// A query that can't be wrapped for pagination is still served
+	queryHandler, err = initQueryHandler(testDbPath, "SELECT * FROM ip_dns; -- x", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest("GET", "http://example.org/query", nil))
+	var fullResponse []queryResult
+	err = json.NewDecoder(w.Result().Body).Decode(&fullResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fullResponse) != 1 || len(fullResponse[0].Out) != 4 {
+		t.Fatalf(`fullResponse (%v) should have the 4 rows of ip_dns`, fullResponse)
+	}
+}
+
+func TestPaginationBadCursorColumn(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	_, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns", 0, withCursorColumn("banana"))
+	if err == nil {
+		t.Fatal(`Should throw an error`)
+	}
+}
+
+func TestPaginationCursorColumnNotUnique(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	// The 2 rows of github.com would be split between pages, and the second one skipped
+	_, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns", 0, withCursorColumn("dns"))
+	if err == nil {
+		t.Fatal(`--cursor-column of a column with duplicate values should fail`)
+	}
+
+	_, err = initQueryHandler(testDbPath, "SELECT ip, CASE WHEN ip = '1.1.1.1' THEN NULL ELSE ip END AS k FROM ip_dns", 0, withCursorColumn("k"))
+	if err == nil {
+		t.Fatal(`--cursor-column of a column with NULL values should fail`)
+	}
+}
+
+func TestCursorKey(t *testing.T) {
+	for _, test := range []struct {
+		cursor   pageCursor
+		expected interface{}
+	}{
+		{pageCursor{Key: int64(9007199254740993)}, int64(9007199254740993)}, // Not exact as a float64
+		{pageCursor{Key: 1.5}, 1.5},
+		{pageCursor{Key: "github.com"}, "github.com"},
+	} {
+		cursorJSON, err := json.Marshal(test.cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded pageCursor
+		decoder := json.NewDecoder(bytes.NewReader(cursorJSON))
+		decoder.UseNumber()
+		err = decoder.Decode(&decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if key := cursorKey(decoded.Key); key != test.expected {
+			t.Fatalf(`cursorKey(%s) (%#v) != %#v`, cursorJSON, key, test.expected)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+var pragmaNameRegex = regexp.MustCompile(`^[A-Za-z_]+$`)
+var pragmaValueRegex = regexp.MustCompile(`^([A-Za-z0-9_.+-]+|'[^']*')$`)
+
+// Each driver with init statements is registered under a unique name
+var initDriverCount uint64
+
+// stringsFlag is a flag that can be repeated, e.g. "--pragma a=1 --pragma b=2"
+type stringsFlag []string
+
+func (flag *stringsFlag) String() string {
+	return strings.Join(*flag, ",")
+}
+
+func (flag *stringsFlag) Set(value string) error {
+	*flag = append(*flag, value)
+	return nil
+}
+
+// parsePragma validates a "name=value" PRAGMA and returns its name
+// and the statement that sets it
+func parsePragma(pragma string) (string, string, error) {
+	eq := strings.Index(pragma, "=")
+	if eq == -1 {
+		return "", "", fmt.Errorf("PRAGMA '%s' must be 'name=value'", pragma)
+	}
+
+	name := strings.TrimSpace(pragma[:eq])
+	value := strings.TrimSpace(pragma[eq+1:])
+	if !pragmaNameRegex.MatchString(name) {
+		return "", "", fmt.Errorf("Invalid PRAGMA name '%s'", name)
+	}
+	if !pragmaValueRegex.MatchString(value) {
+		return "", "", fmt.Errorf("Invalid PRAGMA value '%s' for '%s'", value, name)
+	}
+
+	return name, fmt.Sprintf("PRAGMA %s = %s", name, value), nil
+}
+
+// initDriverName returns the name of a SQLite driver that executes
+// pragmas ("name=value") and then initSQL on every new connection.
+// Without any of them it's the default "sqlite3" driver.
+func initDriverName(pragmas []string, initSQL string) (string, error) {
+	var statements []string
+	for _, pragma := range pragmas {
+		_, statement, err := parsePragma(pragma)
+		if err != nil {
+			return "", err
+		}
+		statements = append(statements, statement)
+	}
+	if strings.TrimSpace(initSQL) != "" {
+		statements = append(statements, initSQL)
+	}
+
+	if len(statements) == 0 {
+		return "sqlite3", nil
+	}
+
+	driverName := fmt.Sprintf("sqlite3_init_%d", atomic.AddUint64(&initDriverCount, 1))
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			for _, statement := range statements {
+				_, err := conn.Exec(statement, nil)
+				if err != nil {
+					return fmt.Errorf("Cannot init connection with '%s': %v", statement, err)
+				}
+			}
+			return nil
+		},
+	})
+
+	return driverName, nil
+}
+
+// connectionSettings returns the effective values of pragmas on db,
+// as "name = value" lines, along with initSQL
+func connectionSettings(db *sql.DB, pragmas []string, initSQL string) ([]string, error) {
+	var settings []string
+	for _, pragma := range pragmas {
+		name, _, err := parsePragma(pragma)
+		if err != nil {
+			return nil, err
+		}
+
+		var value interface{}
+		err = db.QueryRow("PRAGMA " + name).Scan(&value)
+		if err == sql.ErrNoRows {
+			// e.g. a PRAGMA that can only be set
+			value = "(no value)"
+		} else if err != nil {
+			return nil, fmt.Errorf("Cannot read PRAGMA '%s': %v", name, err)
+		}
+
+		if v, ok := value.([]byte); ok {
+			value = string(v)
+		}
+		settings = append(settings, fmt.Sprintf("PRAGMA %s = %v", name, value))
+	}
+	if strings.TrimSpace(initSQL) != "" {
+		settings = append(settings, "Init SQL: "+initSQL)
+	}
+
+	return settings, nil
+}
+
+// logConnectionSettings logs settings and returns their help message section
+func logConnectionSettings(settings []string) string {
+	if len(settings) == 0 {
+		return ""
+	}
+
+	helpMessage := "Connection settings:\n"
+	for _, setting := range settings {
+		log.Printf("Connection setting: %s\n", setting)
+		helpMessage += "\t" + setting + "\n"
+	}
+
+	return helpMessage + "\n"
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPragmas(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0,
+		withConnectionInit([]string{"mmap_size=268435456", "temp_store=memory"}, "CREATE TEMP VIEW dns_count AS SELECT count(*) FROM ip_dns"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The help message shows the effective settings
+	req := httptest.NewRequest("GET", "http://example.org/banana", nil)
+	w := httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, setting := range []string{
+		"PRAGMA mmap_size = 268435456",
+		"PRAGMA temp_store = 2",
+		"Init SQL: CREATE TEMP VIEW dns_count",
+	} {
+		if !strings.Contains(string(body), setting) {
+			t.Fatalf(`Help message should contain "%s": %s`, setting, body)
+		}
+	}
+
+	// query_only rejects writes
+	queryHandler, err = initQueryHandler(testDbPath, "DELETE FROM ip_dns WHERE dns = ?", 0,
+		withConnectionInit([]string{"query_only=1"}, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = httptest.NewRequest("POST", "http://example.org/query", strings.NewReader("github.com"))
+	w = httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp = w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusInternalServerError (%d)`, resp.StatusCode, http.StatusInternalServerError)
+	}
+}
+
+func TestBadPragmas(t *testing.T) {
+	for _, pragmas := range [][]string{
+		{"mmap_size"},
+		{"mmap_size; DROP TABLE ip_dns=1"},
+		{"mmap_size=1; DROP TABLE ip_dns"},
+	} {
+		_, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withConnectionInit(pragmas, ""))
+		if err == nil {
+			t.Fatalf(`Should fail with pragmas %v`, pragmas)
+		}
+	}
+
+	_, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withConnectionInit(nil, "SELECT * FROM banana"))
+	if err == nil {
+		t.Fatal(`Should fail with a bad init SQL`)
+	}
+}
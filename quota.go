@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Idle clients with full buckets are forgotten after this long
+const quotaIdleTimeout = 5 * time.Minute
+
+// quotaSettings limits each client, 0 means unlimited
+type quotaSettings struct {
+	requestsRate  float64 // Requests per second
+	requestsBurst int     // Requests above requestsRate, 0 means ceil(requestsRate)
+	linesRate     float64 // Lines (queries) per second
+	linesBurst    int     // Lines above linesRate, 0 means ceil(linesRate)
+	maxConcurrent int     // Requests in flight
+}
+
+// enabled reports whether any of the quotas is set
+func (settings quotaSettings) enabled() bool {
+	return settings.requestsRate != 0 || settings.linesRate != 0 || settings.maxConcurrent != 0
+}
+
+// tokenBucket allows rate tokens per second, with bursts of up to burst tokens
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) tokenBucket {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (bucket *tokenBucket) refill(now time.Time) {
+	if now.After(bucket.last) {
+		bucket.tokens = math.Min(bucket.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+		bucket.last = now
+	}
+}
+
+// wait returns how long until the bucket has a token, 0 if it has one now
+func (bucket *tokenBucket) wait(now time.Time) time.Duration {
+	bucket.refill(now)
+	if bucket.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / bucket.rate * float64(time.Second))
+}
+
+// take takes n tokens. The bucket may go into debt, that later requests wait for.
+func (bucket *tokenBucket) take(n float64, now time.Time) {
+	bucket.refill(now)
+	bucket.tokens -= n
+}
+
+func (bucket *tokenBucket) full(now time.Time) bool {
+	bucket.refill(now)
+	return bucket.tokens >= bucket.burst
+}
+
+// clientQuota is the limit state of one client
+type clientQuota struct {
+	requests tokenBucket
+	lines    tokenBucket
+	inFlight int
+	lastSeen time.Time
+
+	throttled uint64
+}
+
+// quotas limits the requests of each client, so a heavy client can't starve the others
+type quotas struct {
+	settings quotaSettings
+
+	mutex     sync.Mutex
+	clients   map[string]*clientQuota
+	lastPrune time.Time
+
+	throttledRequests    uint64
+	throttledLines       uint64
+	throttledConcurrency uint64
+}
+
+func newQuotas(settings quotaSettings) (*quotas, error) {
+	if settings.requestsRate < 0 || settings.linesRate < 0 || settings.maxConcurrent < 0 {
+		return nil, fmt.Errorf("Client rate limits and max concurrent requests must not be negative")
+	}
+
+	return &quotas{
+		settings:  settings,
+		clients:   map[string]*clientQuota{},
+		lastPrune: time.Now(),
+	}, nil
+}
+
+// quotaError is the reason a request was throttled
+type quotaError struct {
+	reason     string
+	retryAfter time.Duration
+}
+
+func (err *quotaError) Error() string {
+	return err.reason
+}
+
+// acquire admits a request of client, and returns a function to call when it's done.
+// It returns a *quotaError if the client is over one of its limits.
+func (q *quotas) acquire(client string, now time.Time) (func(), error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.prune(now)
+
+	quota, ok := q.clients[client]
+	if !ok {
+		quota = &clientQuota{
+			requests: newTokenBucket(q.settings.requestsRate, q.settings.requestsBurst, now),
+			lines:    newTokenBucket(q.settings.linesRate, q.settings.linesBurst, now),
+		}
+		q.clients[client] = quota
+	}
+	quota.lastSeen = now
+
+	if q.settings.maxConcurrent > 0 && quota.inFlight >= q.settings.maxConcurrent {
+		quota.throttled++
+		q.throttledConcurrency++
+		return nil, &quotaError{fmt.Sprintf("Client '%s' has %d requests in flight", client, quota.inFlight), time.Second}
+	}
+	if q.settings.requestsRate > 0 {
+		if wait := quota.requests.wait(now); wait > 0 {
+			quota.throttled++
+			q.throttledRequests++
+			return nil, &quotaError{fmt.Sprintf("Client '%s' exceeded %g requests per second", client, q.settings.requestsRate), wait}
+		}
+	}
+	if q.settings.linesRate > 0 {
+		if wait := quota.lines.wait(now); wait > 0 {
+			quota.throttled++
+			q.throttledLines++
+			return nil, &quotaError{fmt.Sprintf("Client '%s' exceeded %g lines per second", client, q.settings.linesRate), wait}
+		}
+	}
+
+	if q.settings.requestsRate > 0 {
+		quota.requests.take(1, now)
+	}
+	quota.inFlight++
+
+	return func() {
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		quota.inFlight--
+	}, nil
+}
+
+// takeLine counts a line (query) of a request of client.
+// The request isn't stopped, later requests wait until the client is under its limit again.
+func (q *quotas) takeLine(client string) {
+	if q == nil || q.settings.linesRate <= 0 {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if quota, ok := q.clients[client]; ok {
+		quota.lines.take(1, time.Now())
+	}
+}
+
+// prune forgets idle clients that are under their limits, at most once a minute
+func (q *quotas) prune(now time.Time) {
+	if now.Sub(q.lastPrune) < time.Minute {
+		return
+	}
+	q.lastPrune = now
+
+	for client, quota := range q.clients {
+		if quota.inFlight == 0 && now.Sub(quota.lastSeen) > quotaIdleTimeout && quota.requests.full(now) && quota.lines.full(now) {
+			delete(q.clients, client)
+		}
+	}
+}
+
+// quotaStats are the runtime statistics of the client quotas, reported in "/stats"
+type quotaStats struct {
+	ThrottledRequests    uint64 `json:"throttled_requests"`
+	ThrottledLines       uint64 `json:"throttled_lines"`
+	ThrottledConcurrency uint64 `json:"throttled_concurrency"`
+}
+
+// clientQuotaStats are the state of a client's quotas, reported only by the admin API
+// because they list the clients' identities and IP addresses
+type clientQuotaStats struct {
+	Client         string   `json:"client"`
+	InFlight       int      `json:"in_flight"`
+	RequestsTokens *float64 `json:"requests_tokens,omitempty"` // Negative while the client is in debt
+	LinesTokens    *float64 `json:"lines_tokens,omitempty"`
+	Throttled      uint64   `json:"throttled"`
+}
+
+func (q *quotas) stats() quotaStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return quotaStats{
+		ThrottledRequests:    q.throttledRequests,
+		ThrottledLines:       q.throttledLines,
+		ThrottledConcurrency: q.throttledConcurrency,
+	}
+}
+
+// clientStats returns the state of each client's quotas, sorted by client
+func (q *quotas) clientStats() []clientQuotaStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := time.Now()
+	stats := make([]clientQuotaStats, 0, len(q.clients))
+	for client, quota := range q.clients {
+		clientStats := clientQuotaStats{
+			Client:    client,
+			InFlight:  quota.inFlight,
+			Throttled: quota.throttled,
+		}
+		if q.settings.requestsRate > 0 {
+			quota.requests.refill(now)
+			tokens := math.Round(quota.requests.tokens*100) / 100
+			clientStats.RequestsTokens = &tokens
+		}
+		if q.settings.linesRate > 0 {
+			quota.lines.refill(now)
+			tokens := math.Round(quota.lines.tokens*100) / 100
+			clientStats.LinesTokens = &tokens
+		}
+		stats = append(stats, clientStats)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Client < stats[j].Client
+	})
+
+	return stats
+}
+
+// retryAfterSeconds is the Retry-After header of a wait, in whole seconds (at least 1)
+func retryAfterSeconds(wait time.Duration) int {
+	return int(math.Max(1, math.Ceil(wait.Seconds())))
+}
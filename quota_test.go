@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	json "github.com/json-iterator/go"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(2, 0, now)
+
+	for i := 0; i < 2; i++ {
+		if wait := bucket.wait(now); wait != 0 {
+			t.Fatalf(`request %d: wait() (%v) != 0`, i, wait)
+		}
+		bucket.take(1, now)
+	}
+	if wait := bucket.wait(now); wait != 500*time.Millisecond {
+		t.Fatalf(`wait() (%v) != 500ms`, wait)
+	}
+	if wait := bucket.wait(now.Add(500 * time.Millisecond)); wait != 0 {
+		t.Fatalf(`wait() after refill (%v) != 0`, wait)
+	}
+
+	// Debt is paid before the next token
+	bucket.take(3, now.Add(500*time.Millisecond))
+	if wait := bucket.wait(now.Add(500 * time.Millisecond)); wait != 1500*time.Millisecond {
+		t.Fatalf(`wait() in debt (%v) != 1.5s`, wait)
+	}
+}
+
+func TestQuotasRequestsRate(t *testing.T) {
+	q, err := newQuotas(quotaSettings{requestsRate: 1, requestsBurst: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		release, err := q.acquire("batch", now)
+		if err != nil {
+			t.Fatalf(`request %d: acquire() failed: %v`, i, err)
+		}
+		release()
+	}
+
+	_, err = q.acquire("batch", now)
+	quotaErr, ok := err.(*quotaError)
+	if !ok || quotaErr.retryAfter != time.Second {
+		t.Fatalf(`acquire() over the rate should fail with a 1s retry, got %v`, err)
+	}
+
+	// Other clients aren't affected
+	release, err := q.acquire("interactive", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	release, err = q.acquire("batch", now.Add(time.Second))
+	if err != nil {
+		t.Fatalf(`acquire() after a refill failed: %v`, err)
+	}
+	release()
+
+	stats := q.stats()
+	clients := q.clientStats()
+	if stats.ThrottledRequests != 1 || len(clients) != 2 || clients[0].Client != "batch" || clients[0].Throttled != 1 {
+		t.Fatalf(`stats() (%+v, %+v) should count 1 throttled request of "batch"`, stats, clients)
+	}
+}
+
+func TestQuotasMaxConcurrent(t *testing.T) {
+	q, err := newQuotas(quotaSettings{maxConcurrent: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	release, err := q.acquire("batch", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = q.acquire("batch", now)
+	if _, ok := err.(*quotaError); !ok {
+		t.Fatalf(`acquire() over max concurrent should fail, got %v`, err)
+	}
+
+	release()
+	release, err = q.acquire("batch", now)
+	if err != nil {
+		t.Fatalf(`acquire() after release failed: %v`, err)
+	}
+	release()
+}
+
+func TestQuotasLinesRate(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withQuotas(quotaSettings{linesRate: 1, linesBurst: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(remoteAddr string) *http.Response {
+		req := httptest.NewRequest("POST", "http://example.org/query", strings.NewReader("github.com\ngithub.com\ngithub.com\ngithub.com"))
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		queryHandler(w, req)
+		return w.Result()
+	}
+
+	// A request isn't stopped in the middle, it puts its client in debt
+	resp := request("192.0.2.1:1234")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+	}
+
+	resp = request("192.0.2.1:1235")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusTooManyRequests (%d)`, resp.StatusCode, http.StatusTooManyRequests)
+	}
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || retryAfter < 2 || retryAfter > 3 {
+		t.Fatalf(`Retry-After (%s) should be 3 seconds, the time to pay the debt of 2 lines and get another`, resp.Header.Get("Retry-After"))
+	}
+
+	// Clients are identified by their IP address
+	resp = request("192.0.2.2:1234")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(`other client: resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+	}
+
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest("GET", "http://example.org/stats", nil))
+
+	var response stats
+	err = json.NewDecoder(w.Result().Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Quotas == nil || response.Quotas.ThrottledLines != 1 {
+		t.Fatalf(`stats (%+v) should have 1 throttled request`, response.Quotas)
+	}
+
+	// The clients are listed only by the admin API
+	w = httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest("GET", "http://example.org/admin/quotas", nil))
+
+	var clients []clientQuotaStats
+	err = json.NewDecoder(w.Result().Body).Decode(&clients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 2 || *clients[0].LinesTokens >= 0 {
+		t.Fatalf(`clients (%+v) should be 2 clients in debt`, clients)
+	}
+}
+
+func TestQuotasAdminOnly(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	server, err := newQueryServer(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withQuotas(quotaSettings{requestsRate: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(server, publicListener, adminListener, nil, time.Second, stop)
+	}()
+
+	for _, test := range []struct {
+		url        string
+		statusCode int
+	}{
+		{fmt.Sprintf("http://%s/admin/quotas", publicListener.Addr()), http.StatusNotFound},
+		{fmt.Sprintf("http://%s/admin/quotas", adminListener.Addr()), http.StatusOK},
+	} {
+		resp, err := http.Get(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.statusCode {
+			t.Fatalf(`%s: resp.StatusCode (%d) != %d`, test.url, resp.StatusCode, test.statusCode)
+		}
+	}
+
+	stop <- syscall.SIGTERM
+	err = <-served
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	json "github.com/json-iterator/go"
+)
+
+// Redaction actions of a column
+const (
+	redactionKeep     = "keep"
+	redactionDrop     = "drop"
+	redactionHash     = "hash"
+	redactionTruncate = "truncate"
+	redactionMask     = "mask"
+)
+
+// Characters that "mask" leaves visible by default
+const defaultMaskVisible = 4
+
+// redactionAction is what is done to a column's values
+type redactionAction struct {
+	kind string // One of the redaction* consts
+	n    int    // Characters that "truncate" keeps at the start, or that "mask" leaves visible at the end
+}
+
+// parseRedactionAction parses "keep", "drop", "hash", "truncate:<n>", "mask" or "mask:<n>"
+func parseRedactionAction(action string) (redactionAction, error) {
+	kind, arg := action, ""
+	if colon := strings.Index(action, ":"); colon != -1 {
+		kind, arg = action[:colon], action[colon+1:]
+	}
+
+	switch kind {
+	case redactionKeep, redactionDrop, redactionHash:
+		if arg != "" {
+			return redactionAction{}, fmt.Errorf("Redaction action '%s' takes no argument", kind)
+		}
+		return redactionAction{kind: kind}, nil
+	case redactionTruncate, redactionMask:
+		n := defaultMaskVisible
+		if kind == redactionTruncate || arg != "" {
+			var err error
+			n, err = strconv.Atoi(arg)
+			if err != nil || n < 0 {
+				return redactionAction{}, fmt.Errorf("Redaction action '%s' must be '%s:<characters>'", action, kind)
+			}
+		}
+		return redactionAction{kind: kind, n: n}, nil
+	}
+	return redactionAction{}, fmt.Errorf("Unknown redaction action '%s', must be one of: keep, drop, hash, truncate:<n>, mask, mask:<n>", action)
+}
+
+// apply returns the redacted value, NULL stays NULL
+func (action redactionAction) apply(value interface{}) interface{} {
+	var text string
+	switch value := value.(type) {
+	case nil:
+		return nil
+	case string:
+		text = value
+	case []byte:
+		text = string(value)
+	default:
+		text = fmt.Sprint(value)
+	}
+
+	switch action.kind {
+	case redactionHash:
+		hash := sha256.Sum256([]byte(text))
+		return hex.EncodeToString(hash[:])
+	case redactionTruncate:
+		runes := []rune(text)
+		if len(runes) > action.n {
+			runes = runes[:action.n]
+		}
+		return string(runes)
+	case redactionMask:
+		runes := []rune(text)
+		for i := 0; i < len(runes)-action.n; i++ {
+			runes[i] = '*'
+		}
+		return string(runes)
+	}
+	return value
+}
+
+// redactionRule redacts columns of requests of identities to endpoints, e.g.
+//
+//	{"identities": ["*"], "endpoints": ["/query"], "columns": {"email": "hash", "ip": "truncate:7", "ssn": "drop"}}
+//
+// Identities and endpoints are like in the client ACL, empty means all of them.
+type redactionRule struct {
+	Identities []string          `json:"identities"`
+	Endpoints  []string          `json:"endpoints"`
+	Columns    map[string]string `json:"columns"`
+
+	actions map[string]redactionAction // By lowercase column name
+}
+
+// matches reports whether the rule applies to a request of identity to the endpoint at path
+func (rule *redactionRule) matches(identity string, path string) bool {
+	if len(rule.Identities) > 0 && !containsString(rule.Identities, identity) && !containsString(rule.Identities, "*") {
+		return false
+	}
+	return len(rule.Endpoints) == 0 || endpointAllowed(rule.Endpoints, path)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// redactionPolicy is a list of rules. A column is redacted by the first rule that
+// applies to the request and names it, so an earlier "keep" rule can exempt privileged identities.
+type redactionPolicy []*redactionRule
+
+func loadRedactionPolicy(policyPath string) (redactionPolicy, error) {
+	policyJSON, err := ioutil.ReadFile(policyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load redaction policy: %v", err)
+	}
+
+	var policy redactionPolicy
+	err = json.Unmarshal(policyJSON, &policy)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load redaction policy '%s': %v", policyPath, err)
+	}
+
+	for i, rule := range policy {
+		if rule == nil || len(rule.Columns) == 0 {
+			return nil, fmt.Errorf("Cannot load redaction policy '%s': rule %d has no columns", policyPath, i+1)
+		}
+		rule.actions = map[string]redactionAction{}
+		for column, action := range rule.Columns {
+			rule.actions[strings.ToLower(column)], err = parseRedactionAction(action)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot load redaction policy '%s': rule %d: column '%s': %v", policyPath, i+1, column, err)
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+// redactionRules are the rules of a policy that apply to a request, nil if none
+type redactionRules struct {
+	rules   []*redactionRule
+	indexes []string // Of the rules in the policy
+}
+
+// rulesFor returns the rules that apply to a request of identity to the endpoint at path
+func (policy redactionPolicy) rulesFor(identity string, path string) *redactionRules {
+	var matched redactionRules
+	for i, rule := range policy {
+		if rule.matches(identity, path) {
+			matched.rules = append(matched.rules, rule)
+			matched.indexes = append(matched.indexes, strconv.Itoa(i))
+		}
+	}
+	if len(matched.rules) == 0 {
+		return nil
+	}
+	return &matched
+}
+
+// key identifies the rules, requests with different rules get different responses
+func (matched *redactionRules) key() string {
+	if matched == nil {
+		return ""
+	}
+	return strings.Join(matched.indexes, ",")
+}
+
+// action returns the action of column, by the first rule that names it
+func (matched *redactionRules) action(column string) redactionAction {
+	if matched == nil {
+		return redactionAction{kind: redactionKeep}
+	}
+
+	column = strings.ToLower(column)
+	for _, rule := range matched.rules {
+		if action, ok := rule.actions[column]; ok {
+			return action
+		}
+	}
+	return redactionAction{kind: redactionKeep}
+}
+
+// apply returns a redacted copy of result, result itself may be cached and isn't modified.
+// A redacted column's header is marked with its action, e.g. "email (hash)", and a dropped column is removed.
+func (matched *redactionRules) apply(result queryResult) queryResult {
+	if matched == nil {
+		return result
+	}
+
+	actions := make([]redactionAction, len(result.Headers))
+	redacted := false
+	for i, header := range result.Headers {
+		actions[i] = matched.action(header)
+		if actions[i].kind != redactionKeep {
+			redacted = true
+		}
+	}
+	if !redacted {
+		return result
+	}
+
+	headers := make([]string, 0, len(result.Headers))
+	for i, header := range result.Headers {
+		switch actions[i].kind {
+		case redactionKeep:
+			headers = append(headers, header)
+		case redactionDrop:
+		default:
+			headers = append(headers, fmt.Sprintf("%s (%s)", header, actions[i].kind))
+		}
+	}
+
+	out := make([][]interface{}, len(result.Out))
+	for r, row := range result.Out {
+		out[r] = make([]interface{}, 0, len(headers))
+		for i, value := range row {
+			switch actions[i].kind {
+			case redactionKeep:
+				out[r] = append(out[r], value)
+			case redactionDrop:
+			default:
+				out[r] = append(out[r], actions[i].apply(value))
+			}
+		}
+	}
+
+	result.Headers = headers
+	result.Out = out
+	return result
+}
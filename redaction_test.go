@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	json "github.com/json-iterator/go"
+)
+
+func TestRedactionAction(t *testing.T) {
+	for _, test := range []struct {
+		action   string
+		value    interface{}
+		expected interface{}
+	}{
+		// echo -n github.com | sha256sum
+		{"hash", "github.com", "3aeb002460381c6f258e8395d3026f571f0d9a76488dcd837639b13aed316560"},
+		{"hash", nil, nil},
+		{"truncate:7", "192.30.253.112", "192.30."},
+		{"truncate:7", "1.2.3.4", "1.2.3.4"},
+		{"truncate:2", []byte("héllo"), "hé"},
+		{"mask", "4111111111111111", "************1111"},
+		{"mask:0", "secret", "******"},
+		{"mask:2", int64(12345), "***45"},
+		{"mask", "abc", "abc"},
+		{"keep", int64(7), int64(7)},
+	} {
+		action, err := parseRedactionAction(test.action)
+		if err != nil {
+			t.Fatalf(`parseRedactionAction(%s) failed: %v`, test.action, err)
+		}
+		if redacted := action.apply(test.value); !reflect.DeepEqual(redacted, test.expected) {
+			t.Fatalf(`%s: apply(%v) (%#v) != %#v`, test.action, test.value, redacted, test.expected)
+		}
+	}
+
+	for _, action := range []string{"truncate", "truncate:x", "mask:-1", "drop:1", "encrypt"} {
+		_, err := parseRedactionAction(action)
+		if err == nil {
+			t.Fatalf(`parseRedactionAction(%s) should fail`, action)
+		}
+	}
+}
+
+func TestRedactionPolicy(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "redaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keysPath := filepath.Join(tmpDir, "keys.db")
+	store, err := openKeyStore(keysPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opsKey, _, err := store.add("ops", []string{"*"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	billingKey, _, err := store.add("billing", []string{"*"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.close()
+
+	policyPath := filepath.Join(tmpDir, "redaction.json")
+	err = ioutil.WriteFile(policyPath, []byte(`[
+		{"identities": ["ops"], "columns": {"ip": "keep"}},
+		{"endpoints": ["/query"], "columns": {"IP": "truncate:7", "dns": "drop"}},
+		{"columns": {"dns": "hash"}}
+	]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0,
+		withKeyStore(keysPath), withRedactionPolicy(policyPath), withCache(1<<20, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(key string, method string) queryResult {
+		req := httptest.NewRequest(method, "http://example.org/query?p=github.com", strings.NewReader("github.com"))
+		req.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		queryHandler(w, req)
+
+		resp := w.Result()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+		}
+		var fullResponse []queryResult
+		err = json.NewDecoder(resp.Body).Decode(&fullResponse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fullResponse) != 1 || len(fullResponse[0].Out) != 2 {
+			t.Fatalf(`fullResponse (%v) should have 2 rows`, fullResponse)
+		}
+		return fullResponse[0]
+	}
+
+	// Redacting the cached result of the first request mustn't change it for the others
+	for i := 0; i < 2; i++ {
+		billing := query(billingKey, "POST")
+		if !reflect.DeepEqual(billing.Headers, []string{"ip (truncate)"}) || billing.Out[0][0] != "192.30." {
+			t.Fatalf(`billing: result (%v) should have only the truncated ip`, billing)
+		}
+
+		ops := query(opsKey, "POST")
+		if !reflect.DeepEqual(ops.Headers, []string{"ip"}) || ops.Out[0][0] != "192.30.253.112" {
+			t.Fatalf(`ops: result (%v) should have only the full ip`, ops)
+		}
+	}
+
+	// The ETag depends on the redaction
+	etag := func(key string) string {
+		req := httptest.NewRequest("GET", "http://example.org/query?p=github.com", nil)
+		req.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		queryHandler(w, req)
+		return w.Result().Header.Get("ETag")
+	}
+	if etag(billingKey) == etag(opsKey) {
+		t.Fatalf(`ETags of differently redacted responses should differ`)
+	}
+}
+
+func TestRedactionPolicyPagination(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "redaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	policyPath := filepath.Join(tmpDir, "redaction.json")
+	err = ioutil.WriteFile(policyPath, []byte(`[{"columns": {"ip": "mask"}}]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		cursorColumn string
+		statusCode   int
+	}{
+		{"", http.StatusOK},
+		{"ip", http.StatusForbidden},
+	} {
+		opts := []handlerOption{withRedactionPolicy(policyPath)}
+		if test.cursorColumn != "" {
+			opts = append(opts, withCursorColumn(test.cursorColumn))
+		}
+		queryHandler, err := initQueryHandler(testDbPath, "SELECT ip FROM ip_dns", 0, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest("GET", "http://example.org/query?limit=1", nil))
+
+		resp := w.Result()
+		if resp.StatusCode != test.statusCode {
+			t.Fatalf(`cursor column '%s': resp.StatusCode (%d) != %d`, test.cursorColumn, resp.StatusCode, test.statusCode)
+		}
+		if resp.StatusCode != http.StatusOK {
+			continue
+		}
+
+		var fullResponse []queryResult
+		err = json.NewDecoder(resp.Body).Decode(&fullResponse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fullResponse) != 1 || len(fullResponse[0].Out) != 1 || !strings.HasPrefix(fullResponse[0].Out[0][0].(string), "***") {
+			t.Fatalf(`fullResponse (%v) should have 1 masked row`, fullResponse)
+		}
+	}
+}
+
+func TestRedactionPolicyRegisteredQuery(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "redaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	registeredQuery := "SELECT * FROM ip_dns WHERE dns = ?"
+	hash := hashQuery(registeredQuery)
+
+	policyPath := filepath.Join(tmpDir, "redaction.json")
+	err = ioutil.WriteFile(policyPath, []byte(`[{"endpoints": ["/q/`+hash+`"], "columns": {"ip": "drop"}}]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := newQueryServer(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0,
+		withRegistry(filepath.Join(tmpDir, "registry.db")), withRedactionPolicy(policyPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	_, err = server.registry.register(registeredQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	server.serveHTTP(w, httptest.NewRequest("POST", "http://example.org/q/"+hash, strings.NewReader("github.com")))
+	var fullResponse []queryResult
+	err = json.NewDecoder(w.Result().Body).Decode(&fullResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fullResponse) != 1 || !reflect.DeepEqual(fullResponse[0].Headers, []string{"dns"}) {
+		t.Fatalf(`fullResponse (%v) should have only the dns column`, fullResponse)
+	}
+
+	// Another case of the hash would be another path, which the rule doesn't match
+	w = httptest.NewRecorder()
+	server.serveHTTP(w, httptest.NewRequest("POST", "http://example.org/q/"+strings.ToUpper(hash), strings.NewReader("github.com")))
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusNotFound (%d)`, w.Result().StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestLoadRedactionPolicy(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "redaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, policyJSON := range []string{`[{"columns": {}}]`, `[{"columns": {"ip": "encrypt"}}]`, `{"columns": {"ip": "drop"}}`, `[`} {
+		policyPath := filepath.Join(tmpDir, "redaction.json")
+		err = ioutil.WriteFile(policyPath, []byte(policyJSON), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = loadRedactionPolicy(policyPath)
+		if err == nil {
+			t.Fatalf(`loadRedactionPolicy() should fail with %s`, policyJSON)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	json "github.com/json-iterator/go"
+)
+
+// registeredQuery is a query that was registered through the admin API
+type registeredQuery struct {
+	Hash  string `json:"hash"`
+	Query string `json:"query"`
+}
+
+// registry holds the persisted queries, prepared on the served database.
+// Registered queries are executed with "/q/<sha256 of the query>".
+type registry struct {
+	db         *sql.DB // The served database, queries are prepared on it
+	store      *sql.DB // The sidecar database, queries are persisted in it
+	serverPort uint
+
+	mutex   sync.RWMutex
+	queries map[string]*preparedQuery
+}
+
+func initRegistry(registryPath string, db *sql.DB, serverPort uint) (*registry, error) {
+	store, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=rwc&_journal_mode=WAL", registryPath))
+	if err != nil {
+		return nil, err
+	}
+
+	store.SetMaxOpenConns(1)
+
+	_, err = store.Exec(`CREATE TABLE IF NOT EXISTS queries (
+		hash TEXT PRIMARY KEY,
+		query TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("Cannot init registry '%s': %v", registryPath, err)
+	}
+
+	reg := &registry{
+		db:         db,
+		store:      store,
+		serverPort: serverPort,
+		queries:    map[string]*preparedQuery{},
+	}
+
+	rows, err := store.Query("SELECT hash, query FROM queries")
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("Cannot load registry '%s': %v", registryPath, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash, queryString string
+		err = rows.Scan(&hash, &queryString)
+		if err != nil {
+			store.Close()
+			return nil, fmt.Errorf("Cannot load registry '%s': %v", registryPath, err)
+		}
+
+		// A query that doesn't prepare anymore (e.g. the schema changed)
+		// shouldn't prevent the server from starting
+		query, err := prepareQuery(db, queryString, "/q/"+hash, serverPort, "")
+		if err != nil {
+			log.Printf("Skipping registered query %s: %v\n", hash, err)
+			continue
+		}
+
+		reg.queries[hash] = query
+	}
+	err = rows.Err()
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("Cannot load registry '%s': %v", registryPath, err)
+	}
+
+	log.Printf("Loaded %d registered queries from '%s'\n", len(reg.queries), registryPath)
+
+	return reg, nil
+}
+
+func hashQuery(queryString string) string {
+	hash := sha256.Sum256([]byte(queryString))
+	return hex.EncodeToString(hash[:])
+}
+
+// swap prepares the registered queries on db, which replaces the served database.
+// It fails if a query doesn't prepare or its columns changed,
+// otherwise it returns the previous queries, to be closed once their requests drain.
+func (reg *registry) swap(db *sql.DB) ([]*preparedQuery, error) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	queries := map[string]*preparedQuery{}
+	oldQueries := []*preparedQuery{}
+	for hash, oldQuery := range reg.queries {
+		query, err := prepareQuery(db, oldQuery.queryString, "/q/"+hash, reg.serverPort, "")
+		if err == nil {
+			err = checkSameColumns(oldQuery, query)
+			if err != nil {
+				query.close()
+			}
+		}
+		if err != nil {
+			for _, query := range queries {
+				query.close()
+			}
+			return nil, fmt.Errorf("Registered query %s: %v", hash, err)
+		}
+
+		queries[hash] = query
+		oldQueries = append(oldQueries, oldQuery)
+	}
+
+	reg.db = db
+	reg.queries = queries
+
+	return oldQueries, nil
+}
+
+// close closes the registered queries and the sidecar database
+func (reg *registry) close() {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	for _, query := range reg.queries {
+		query.close()
+	}
+	reg.store.Close()
+}
+
+// lookup returns a registered query for a request, which must call query.requests.Done() after use.
+// An unregistered query is closed only after its in-flight requests drain.
+// hash must be lowercase like in "/q/$HASH" links, so a request can't bypass the client ACL,
+// the API key scopes or the redaction rules of its query's path by changing its case.
+func (reg *registry) lookup(hash string) (*preparedQuery, bool) {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	query, ok := reg.queries[hash]
+	if ok {
+		query.requests.Add(1)
+	}
+	return query, ok
+}
+
+// register validates and prepares queryString, then persists it.
+// Registering an already registered query is a no-op.
+func (reg *registry) register(queryString string) (string, error) {
+	hash := hashQuery(queryString)
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	if _, ok := reg.queries[hash]; ok {
+		return hash, nil
+	}
+
+	query, err := prepareQuery(reg.db, queryString, "/q/"+hash, reg.serverPort, "")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = reg.store.Exec("INSERT OR REPLACE INTO queries (hash, query) VALUES (?, ?)", hash, queryString)
+	if err != nil {
+		query.close()
+		return "", err
+	}
+
+	reg.queries[hash] = query
+
+	return hash, nil
+}
+
+// unregister removes a registered query, it returns false if hash isn't registered
+func (reg *registry) unregister(hash string) (bool, error) {
+	hash = strings.ToLower(hash)
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	query, ok := reg.queries[hash]
+	if !ok {
+		return false, nil
+	}
+
+	_, err := reg.store.Exec("DELETE FROM queries WHERE hash = ?", hash)
+	if err != nil {
+		return false, err
+	}
+
+	delete(reg.queries, hash)
+
+	// Requests that looked it up before it was deleted may still use it
+	go func() {
+		query.requests.Wait()
+		query.close()
+	}()
+
+	return true, nil
+}
+
+func (reg *registry) list() []registeredQuery {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	list := make([]registeredQuery, 0, len(reg.queries))
+	for hash, query := range reg.queries {
+		list = append(list, registeredQuery{hash, query.queryString})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Hash < list[j].Hash })
+
+	return list
+}
+
+const registryHelpMessage = `Admin API:
+	$ curl "http://$ADMIN_ADDRESS/admin/queries" --data-binary "$SQL_QUERY"
+	$ curl "http://$ADMIN_ADDRESS/admin/queries"
+	$ curl "http://$ADMIN_ADDRESS/admin/queries/$HASH"
+	$ curl -X DELETE "http://$ADMIN_ADDRESS/admin/queries/$HASH"
+
+	- HTTP POST to "/admin/queries" registers the query in the request body.
+	- HTTP GET to "/admin/queries" lists the registered queries.
+	- HTTP GET to "/admin/queries/$HASH" returns a registered query.
+	- HTTP DELETE to "/admin/queries/$HASH" unregisters a query.
+	- $HASH is the lowercase hex encoded SHA256 of the query string.
+	- A registered query is executed with "http://$ADDRESS:$PORT/q/$HASH".
+
+For more info visit https://github.com/assafmo/SQLiteQueryServer
+`
+
+func (reg *registry) adminHandler(w http.ResponseWriter, r *http.Request) {
+	hash := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/queries"), "/")
+
+	var response interface{}
+	switch {
+	case hash == "" && r.Method == "GET":
+		response = reg.list()
+	case hash == "" && r.Method == "POST":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("\n\nError reading request body: %v\n\n%s", err, registryHelpMessage), http.StatusInternalServerError)
+			return
+		}
+
+		queryString := string(body)
+		if strings.TrimSpace(queryString) == "" {
+			http.Error(w, fmt.Sprintf("\n\nRequest body must be a SQL query\n\n%s", registryHelpMessage), http.StatusBadRequest)
+			return
+		}
+
+		hash, err = reg.register(queryString)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("\n\nError registering query: %v\n\n%s", err, registryHelpMessage), http.StatusBadRequest)
+			return
+		}
+
+		log.Printf("Registered query %s: '%s'\n", hash, queryString)
+		response = registeredQuery{hash, queryString}
+	case hash != "" && r.Method == "GET":
+		reg.mutex.RLock()
+		query, ok := reg.queries[strings.ToLower(hash)]
+		reg.mutex.RUnlock()
+
+		if !ok {
+			http.Error(w, fmt.Sprintf("\n\nQuery %s is not registered\n\n%s", hash, registryHelpMessage), http.StatusNotFound)
+			return
+		}
+		response = registeredQuery{strings.ToLower(hash), query.queryString}
+	case hash != "" && r.Method == "DELETE":
+		ok, err := reg.unregister(hash)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("\n\nError unregistering query: %v\n\n%s", err, registryHelpMessage), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, fmt.Sprintf("\n\nQuery %s is not registered\n\n%s", hash, registryHelpMessage), http.StatusNotFound)
+			return
+		}
+
+		log.Printf("Unregistered query %s\n", hash)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, registryHelpMessage, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+
+	answerJSON, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("\n\nError encoding json: %v\n\n%s", err, registryHelpMessage), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(answerJSON)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("\n\nError sending json to client: %v\n\n%s", err, registryHelpMessage), http.StatusInternalServerError)
+		return
+	}
+}
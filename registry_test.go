@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	json "github.com/json-iterator/go"
+)
+
+func TestRegistryRegisterAndExecute(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	registryPath := filepath.Join(tmpDir, "registry.db")
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withRegistry(registryPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryString := "SELECT dns FROM ip_dns WHERE ip = ?"
+
+	// Register
+	req := httptest.NewRequest("POST",
+		"http://example.org/admin/queries",
+		strings.NewReader(queryString))
+	w := httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+	}
+
+	var registered registeredQuery
+	err = json.NewDecoder(resp.Body).Decode(&registered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registered.Hash != hashQuery(queryString) {
+		t.Fatalf(`registered.Hash (%s) != hashQuery(queryString) (%s)`, registered.Hash, hashQuery(queryString))
+	}
+
+	// Execute
+	req = httptest.NewRequest("POST",
+		"http://example.org/q/"+registered.Hash,
+		strings.NewReader("1.1.1.1\n8.8.8.8"))
+	w = httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp = w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+	}
+
+	var fullResponse []queryResult
+	err = json.NewDecoder(resp.Body).Decode(&fullResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedResponse := []queryResult{
+		{
+			Out: [][]interface{}{
+				{"one.one.one.one"},
+			}},
+		{
+			Out: [][]interface{}{
+				{"google-public-dns-a.google.com"},
+			}},
+	}
+
+	compare(t, fullResponse, expectedResponse)
+
+	// Registered queries are persisted
+	queryHandler, err = initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withRegistry(registryPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = httptest.NewRequest("GET",
+		"http://example.org/admin/queries/"+registered.Hash,
+		nil)
+	w = httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp = w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+	}
+
+	// Unregister
+	req = httptest.NewRequest("DELETE",
+		"http://example.org/admin/queries/"+registered.Hash,
+		nil)
+	w = httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp = w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusNoContent (%d)`, resp.StatusCode, http.StatusNoContent)
+	}
+
+	req = httptest.NewRequest("POST",
+		"http://example.org/q/"+registered.Hash,
+		strings.NewReader("1.1.1.1"))
+	w = httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp = w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusNotFound (%d)`, resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestRegistryRegisterInvalidQuery(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withRegistry(filepath.Join(tmpDir, "registry.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST",
+		"http://example.org/admin/queries",
+		strings.NewReader("BANANA * FROM ip_dns"))
+	w := httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusBadRequest (%d)`, resp.StatusCode, http.StatusBadRequest)
+	}
+
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(respBytes), "syntax error") {
+		t.Fatal(`Error string should contain "syntax error"`)
+	}
+}
+
+func TestRegistryUnregisterInFlight(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	server, err := newQueryServer(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withRegistry(filepath.Join(tmpDir, "registry.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	hash, err := server.registry.register("SELECT dns FROM ip_dns WHERE ip = ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A request looked up the query before it was unregistered
+	query, ok := server.registry.lookup(hash)
+	if !ok {
+		t.Fatalf(`lookup(%s) should find the registered query`, hash)
+	}
+	ok, err = server.registry.unregister(hash)
+	if err != nil || !ok {
+		t.Fatalf(`unregister(%s) failed: %v`, hash, err)
+	}
+	if _, ok := server.registry.lookup(hash); ok {
+		t.Fatalf(`lookup(%s) shouldn't find the unregistered query`, hash)
+	}
+
+	result, err := runQuery(context.Background(), query.queryStmt, []string{"1.1.1.1"}, []interface{}{"1.1.1.1"}, 0)
+	if err != nil {
+		t.Fatalf(`the in-flight request should still execute the unregistered query: %v`, err)
+	}
+	if len(result.Out) != 1 {
+		t.Fatalf(`result.Out (%v) should have 1 row`, result.Out)
+	}
+	query.requests.Done()
+}
+
+func TestRegistryNotEnabled(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET",
+		"http://example.org/admin/queries",
+		nil)
+	w := httptest.NewRecorder()
+	queryHandler(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusNotFound (%d)`, resp.StatusCode, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dbHandle is an open database, with the query prepared on it.
+// Requests hold the handle they use, so that a swapped database
+// is closed only after its in-flight requests drain.
+type dbHandle struct {
+	db         *sql.DB
+	query      *preparedQuery
+	tempPath   string // The decompressed database file, removed on close, "" if none
+	generation uint64 // The server's reloads when the database was switched to, part of its version
+	requests   sync.WaitGroup
+}
+
+// openDatabase opens the database file at dbPath and prepares the query on it
+func (server *queryServer) openDatabase(dbPath string) (*dbHandle, error) {
+	options := server.options
+	handle := &dbHandle{}
+	openMode := options.openMode
+	var err error
+
+	if compressionFormat(dbPath) != "" && !options.inMemory {
+		// The in-memory database is loaded directly from the compressed file
+		dbPath, err = decompressDatabase(dbPath)
+		if err != nil {
+			return nil, err
+		}
+		handle.tempPath = dbPath
+
+		// Writes to the temp file would be lost when it's removed on reload or shutdown,
+		// and nothing else uses it
+		openMode = openModeImmutable
+	}
+
+	if options.inMemory {
+		// The file is only read
+		handle.db, err = openInMemoryDB(server.driverName, dbPath, openMode)
+	} else {
+		handle.db, err = openDatabaseFile(server.driverName, dbPath, openMode)
+	}
+	if err != nil {
+		handle.close()
+		return nil, err
+	}
+
+	settings, err := connectionSettings(handle.db, options.pragmas, options.initSQL)
+	if err != nil {
+		handle.close()
+		return nil, err
+	}
+
+	handle.query, err = prepareQuery(handle.db, server.queryString, "/query", server.serverPort, options.cursorColumn)
+	if err != nil {
+		handle.close()
+		return nil, err
+	}
+	handle.query.helpMessage = logConnectionSettings(settings) + handle.query.helpMessage
+
+	return handle, nil
+}
+
+func (handle *dbHandle) close() {
+	if handle.query != nil {
+		handle.query.close()
+	}
+	if handle.db != nil {
+		handle.db.Close()
+	}
+	if handle.tempPath != "" {
+		removeDatabaseFile(handle.tempPath)
+	}
+}
+
+// acquire returns the current database handle, which must be released after use
+func (server *queryServer) acquire() *dbHandle {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+
+	handle := server.current
+	handle.requests.Add(1)
+	return handle
+}
+
+func (handle *dbHandle) release() {
+	handle.requests.Done()
+}
+
+// reload reloads the database from its file. An in-memory database is loaded into a new
+// in-memory database, and a database file is opened again, then it's swapped like swap() does,
+// so a database that fails to load or whose columns changed isn't served.
+func (server *queryServer) reload() error {
+	return server.swap()
+}
+
+// checkSwappable makes sure that the database file can be opened again
+// while the current one is still open. The files of read-write (WAL mode) databases
+// are shared by path, so the new file would use the old file's "-wal" and "-shm" files.
+func (server *queryServer) checkSwappable() error {
+	if server.options.inMemory || compressionFormat(server.dbPath) != "" {
+		// Served from a private copy
+		return nil
+	}
+
+	switch server.options.openMode {
+	case openModeImmutable:
+		return nil
+	case openModeReadOnly:
+		wal, err := isWALDatabase(server.dbPath)
+		if err != nil {
+			return err
+		}
+		if wal {
+			return fmt.Errorf("Cannot swap WAL mode database '%s' while it's open (use --open-mode=immutable or --in-memory)", server.dbPath)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Cannot swap read-write database '%s' while it's open (use --open-mode=ro, --open-mode=immutable or --in-memory)", server.dbPath)
+}
+
+// swap opens the database file again and validates that the queries are unchanged
+// (they prepare and they have the same columns), then switches requests to it atomically.
+// The previous database is closed after its in-flight requests drain.
+func (server *queryServer) swap() error {
+	err := server.checkSwappable()
+	if err != nil {
+		return err
+	}
+	err = checkDatabaseFile(server.dbPath)
+	if err != nil {
+		return err
+	}
+
+	handle, err := server.openDatabase(server.dbPath)
+	if err != nil {
+		return err
+	}
+
+	current := server.acquire()
+	err = checkSameColumns(current.query, handle.query)
+	current.release()
+	if err != nil {
+		handle.close()
+		return err
+	}
+
+	var oldRegisteredQueries []*preparedQuery
+	if server.registry != nil {
+		oldRegisteredQueries, err = server.registry.swap(handle.db)
+		if err != nil {
+			handle.close()
+			return err
+		}
+	}
+
+	server.mutex.Lock()
+	if server.closed {
+		server.mutex.Unlock()
+		handle.close()
+		return fmt.Errorf("Server is shutting down")
+	}
+	old := server.current
+	server.current = handle
+	// Invalidate results of the previous database
+	handle.generation = atomic.AddUint64(&server.reloads, 1)
+	server.mutex.Unlock()
+
+	go func() {
+		old.requests.Wait()
+
+		for _, query := range oldRegisteredQueries {
+			query.close()
+		}
+		old.close()
+
+		log.Printf("Closed the previous database of '%s', its requests drained\n", server.dbPath)
+	}()
+
+	return nil
+}
+
+// queryColumns returns the columns of query's result, without executing it
+func queryColumns(query *preparedQuery) ([]string, error) {
+	paramsCount, err := countParams(query.queryStmt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Binding the params doesn't execute the query, it's executed on the first rows.Next()
+	rows, err := query.queryStmt.Query(make([]interface{}, paramsCount)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return rows.Columns()
+}
+
+// checkSameColumns makes sure that newQuery has the same columns as oldQuery,
+// so that swapping the database doesn't change the responses' format
+func checkSameColumns(oldQuery *preparedQuery, newQuery *preparedQuery) error {
+	oldColumns, err := queryColumns(oldQuery)
+	if err != nil {
+		return err
+	}
+	newColumns, err := queryColumns(newQuery)
+	if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(oldColumns, newColumns) {
+		return fmt.Errorf("Columns of query '%s' changed from %v to %v", newQuery.queryString, oldColumns, newColumns)
+	}
+	return nil
+}
+
+// reloadLoop reloads the database every reloadInterval (if positive),
+// on every reloadSignal (if not nil), and when the database file changes
+// from dbInfo (checked every watchInterval, if positive)
+func (server *queryServer) reloadLoop(dbInfo os.FileInfo, reloadInterval time.Duration, watchInterval time.Duration, reloadSignal <-chan os.Signal) {
+	var tick, watchTick <-chan time.Time
+	if reloadInterval > 0 {
+		ticker := time.NewTicker(reloadInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	if watchInterval > 0 {
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		watchTick = ticker.C
+	}
+
+	lastInfo := dbInfo
+	var changedInfo os.FileInfo
+
+	for {
+		select {
+		case <-tick:
+		case <-reloadSignal:
+		case <-watchTick:
+			info, err := os.Stat(server.dbPath)
+			if err != nil || sameFileInfo(info, lastInfo) {
+				// e.g. the file is being replaced
+				changedInfo = nil
+				continue
+			}
+			if !sameFileInfo(info, changedInfo) {
+				// Wait for the file to stop changing, e.g. while it's being copied
+				changedInfo = info
+				continue
+			}
+		}
+		changedInfo = nil
+
+		// A failed reload isn't retried until the file changes again
+		lastInfo, _ = os.Stat(server.dbPath)
+
+		err := server.reload()
+		if err != nil {
+			// Keep serving the current database
+			log.Printf("Cannot reload database file '%s': %v\n", server.dbPath, err)
+			continue
+		}
+
+		log.Printf("Reloaded database file '%s'\n", server.dbPath)
+	}
+}
+
+// sameFileInfo reports whether a and b describe the same unchanged file
+func sameFileInfo(a os.FileInfo, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	json "github.com/json-iterator/go"
+)
+
+// replaceDb atomically replaces the database file at dbPath
+// with a new database built by statements
+func replaceDb(t *testing.T, dbPath string, statements ...string) {
+	newPath := dbPath + ".new"
+
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s", newPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range statements {
+		_, err = db.Exec(statement)
+		if err != nil {
+			db.Close()
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	err = os.Rename(newPath, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func queryGithub(t *testing.T, server *queryServer) []queryResult {
+	req := httptest.NewRequest("POST", "http://example.org/query", strings.NewReader("github.com"))
+	w := httptest.NewRecorder()
+	server.serveHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+	}
+
+	var fullResponse []queryResult
+	err := json.NewDecoder(resp.Body).Decode(&fullResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fullResponse
+}
+
+func TestSwap(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbPath := copyTestDb(t, tmpDir)
+
+	server, err := newQueryServer(dbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withOpenMode(openModeImmutable))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compare(t, queryGithub(t, server), []queryResult{
+		{
+			Out: [][]interface{}{
+				{"192.30.253.112", "github.com"},
+				{"192.30.253.113", "github.com"},
+			}},
+	})
+
+	// An in-flight request holds the previous database
+	old := server.acquire()
+
+	replaceDb(t, dbPath,
+		"CREATE TABLE ip_dns (ip TEXT, dns TEXT)",
+		"INSERT INTO ip_dns VALUES ('140.82.121.4', 'github.com')")
+
+	err = server.swap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compare(t, queryGithub(t, server), []queryResult{
+		{
+			Out: [][]interface{}{
+				{"140.82.121.4", "github.com"},
+			}},
+	})
+
+	err = old.db.Ping()
+	if err != nil {
+		t.Fatalf(`The previous database should stay open while it's used: %v`, err)
+	}
+
+	old.release()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for old.db.Ping() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal(`The previous database should be closed after its requests drained`)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSwapBloomFilter(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbPath := copyTestDb(t, tmpDir)
+
+	server, err := newQueryServer(dbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0,
+		withOpenMode(openModeImmutable), withBloomFilter("ip_dns.dns", 1, 0.01))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := func(dns string) int {
+		w := httptest.NewRecorder()
+		server.serveHTTP(w, httptest.NewRequest("POST", "http://example.org/query", strings.NewReader(dns)))
+		var fullResponse []queryResult
+		err := json.NewDecoder(w.Result().Body).Decode(&fullResponse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(fullResponse[0].Out)
+	}
+
+	for i := 0; i < 2; i++ {
+		if rows("example.org") != 0 {
+			t.Fatal(`example.org shouldn't be in the database yet`)
+		}
+	}
+
+	// An in-flight request holds the previous database
+	old := server.acquire()
+
+	replaceDb(t, dbPath,
+		"CREATE TABLE ip_dns (ip TEXT, dns TEXT)",
+		"INSERT INTO ip_dns VALUES ('93.184.216.34', 'example.org')")
+
+	err = server.swap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A filter built from the previous database is never taken for the new one
+	current := server.acquire()
+	oldVersion, err := server.dataVersion(context.Background(), old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newVersion, err := server.dataVersion(context.Background(), current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current.release()
+	if oldVersion == newVersion {
+		t.Fatalf(`The previous and the new database have the same version '%s'`, newVersion)
+	}
+	server.keyFilter.rebuildInBackground(old, oldVersion)
+	old.release()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if rows("example.org") != 1 {
+			t.Fatal(`example.org should be found in the new database`)
+		}
+
+		server.keyFilter.mutex.RLock()
+		version, rebuilding := server.keyFilter.version, server.keyFilter.rebuilding
+		server.keyFilter.mutex.RUnlock()
+		if version == newVersion && !rebuilding {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(`The Bloom filter should have been rebuilt from the new database`)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if rows("example.org") != 1 {
+		t.Fatal(`example.org should be found in the new database`)
+	}
+}
+
+func TestSwapColumnsChanged(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbPath := copyTestDb(t, tmpDir)
+
+	server, err := newQueryServer(dbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withOpenMode(openModeReadOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replaceDb(t, dbPath,
+		"CREATE TABLE ip_dns (dns TEXT, ip TEXT)",
+		"INSERT INTO ip_dns VALUES ('github.com', '140.82.121.4')")
+
+	err = server.swap()
+	if err == nil {
+		t.Fatal(`Should fail when the query's columns changed`)
+	}
+	if !strings.Contains(err.Error(), "Columns of query") {
+		t.Fatalf(`Should fail with a columns error: %v`, err)
+	}
+
+	replaceDb(t, dbPath, "CREATE TABLE banana (x)")
+
+	err = server.swap()
+	if err == nil {
+		t.Fatal(`Should fail when the query doesn't prepare`)
+	}
+
+	// Still served from the previous database
+	if len(queryGithub(t, server)[0].Out) != 2 {
+		t.Fatal(`The previous database should still be served`)
+	}
+}
+
+func TestSwapReadWrite(t *testing.T) {
+	_, err := newQueryServer(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withReload(0, time.Second, nil))
+	if err == nil {
+		t.Fatal(`Should refuse to hot swap a read-write database`)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbPath := copyTestDb(t, tmpDir)
+
+	server, err := newQueryServer(dbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0,
+		withOpenMode(openModeImmutable), withReload(0, 10*time.Millisecond, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replaceDb(t, dbPath,
+		"CREATE TABLE ip_dns (ip TEXT, dns TEXT)",
+		"INSERT INTO ip_dns VALUES ('140.82.121.4', 'github.com')")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for getStats(t, server.serveHTTP).Reloads != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal(`The replaced database file should have been reloaded`)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(queryGithub(t, server)[0].Out) != 1 {
+		t.Fatal(`The replaced database file should be served`)
+	}
+}
+
+func TestSameFileInfo(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "x")
+	err = ioutil.WriteFile(path, []byte("x"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, _ := os.Stat(path)
+	b, _ := os.Stat(path)
+	if !sameFileInfo(a, b) || !sameFileInfo(nil, nil) || sameFileInfo(a, nil) {
+		t.Fatal(`sameFileInfo() is wrong`)
+	}
+
+	err = ioutil.WriteFile(path, []byte("xx"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := os.Stat(path)
+	if sameFileInfo(a, c) {
+		t.Fatal(`A changed file shouldn't be the same`)
+	}
+}
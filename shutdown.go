@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// serve serves server on publicListener, and its admin API on adminListener (if not nil),
+// over TLS if tlsConfig isn't nil, until a stop signal. Then it stops accepting requests,
+// waits up to shutdownTimeout for the in-flight requests, and closes the database.
+func serve(server *queryServer, publicListener net.Listener, adminListener net.Listener, tlsConfig *tls.Config, shutdownTimeout time.Duration, stop <-chan os.Signal) error {
+	// Canceled when the in-flight requests don't finish in time,
+	// canceling it interrupts their running SQLite statements
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	baseContext := func(net.Listener) context.Context {
+		return requestsCtx
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/query", server.serveHTTP)
+	mux.HandleFunc("/stats", server.serveHTTP)
+	if server.registry != nil {
+		mux.HandleFunc("/q/", server.serveHTTP)
+	}
+
+	httpServers := []*http.Server{{Handler: accessLog(mux), BaseContext: baseContext, TLSConfig: tlsConfig}}
+	listeners := []net.Listener{publicListener}
+
+	if adminListener != nil {
+		// The admin API is served only on its own listener,
+		// so registering SQL is never exposed on the public port
+		adminMux := http.NewServeMux()
+		adminMux.HandleFunc("/admin/", server.serveHTTP)
+
+		httpServers = append(httpServers, &http.Server{Handler: accessLog(adminMux), BaseContext: baseContext, TLSConfig: tlsConfig})
+		listeners = append(listeners, adminListener)
+	}
+
+	errs := make(chan error, len(httpServers))
+	for i := range httpServers {
+		go func(httpServer *http.Server, listener net.Listener) {
+			if tlsConfig != nil {
+				// The certificate is in tlsConfig
+				errs <- httpServer.ServeTLS(listener, "", "")
+			} else {
+				errs <- httpServer.Serve(listener)
+			}
+		}(httpServers[i], listeners[i])
+	}
+
+	var err error
+	select {
+	case sig := <-stop:
+		log.Printf("Received %v, shutting down...\n", sig)
+	case err = <-errs:
+		log.Printf("Server failed, shutting down: %v\n", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, httpServer := range httpServers {
+		shutdownErr := httpServer.Shutdown(ctx)
+		if shutdownErr != nil {
+			log.Printf("In-flight requests didn't finish in %v, canceling them\n", shutdownTimeout)
+			cancelRequests()
+			httpServer.Close()
+		}
+	}
+
+	closeErr := server.close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// close checkpoints the WAL into the database file and closes the database,
+// after its in-flight requests drained.
+// The server doesn't serve requests or reload the database after it's closed.
+func (server *queryServer) close() error {
+	server.mutex.Lock()
+	server.closed = true
+	handle := server.current
+	server.mutex.Unlock()
+
+	handle.requests.Wait()
+
+	var err error
+	if !server.options.inMemory && handle.tempPath == "" && (server.options.openMode == openModeReadWrite || server.options.openMode == "") {
+		// Leave no "-wal" file behind
+		_, err = handle.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+		if err != nil {
+			err = fmt.Errorf("Cannot checkpoint the WAL of '%s': %v", server.dbPath, err)
+		}
+	}
+
+	if server.registry != nil {
+		server.registry.close()
+	}
+	if server.keys != nil {
+		server.keys.close()
+	}
+	handle.close()
+
+	log.Printf("Closed database file '%s'\n", server.dbPath)
+
+	return err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func startServe(t *testing.T, server *queryServer, shutdownTimeout time.Duration) (string, chan<- os.Signal, <-chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(server, listener, nil, nil, shutdownTimeout, stop)
+	}()
+
+	return fmt.Sprintf("http://%s/query", listener.Addr()), stop, served
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "shutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbPath := copyTestDb(t, tmpDir)
+
+	server, err := newQueryServer(dbPath, slowQuery, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url, stop, served := startServe(t, server, 10*time.Second)
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Post(url, "text/csv", strings.NewReader("3000000"))
+		if err != nil {
+			t.Error(err)
+		}
+		responses <- resp
+	}()
+
+	// Let the request start
+	time.Sleep(100 * time.Millisecond)
+	stop <- syscall.SIGTERM
+
+	resp := <-responses
+	if resp == nil {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+	}
+
+	err = <-served
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The WAL was checkpointed
+	info, err := os.Stat(dbPath + "-wal")
+	if err == nil && info.Size() != 0 {
+		t.Fatalf(`WAL file should be empty after shutdown, got %d bytes`, info.Size())
+	}
+
+	if server.current.db.Ping() == nil {
+		t.Fatal(`The database should be closed after shutdown`)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	server, err := newQueryServer(testDbPath, slowQuery, 0, withOpenMode(openModeReadOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url, stop, served := startServe(t, server, 50*time.Millisecond)
+
+	go func() {
+		resp, err := http.Post(url, "text/csv", strings.NewReader("1000000000"))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	// Let the request start
+	time.Sleep(100 * time.Millisecond)
+	stop <- syscall.SIGTERM
+
+	select {
+	case err = <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal(`The in-flight request should have been canceled after the shutdown timeout`)
+	}
+
+	if server.current.db.Ping() == nil {
+		t.Fatal(`The database should be closed after shutdown`)
+	}
+}
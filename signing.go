@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/assafmo/SQLiteQueryServer/client"
+	json "github.com/json-iterator/go"
+)
+
+// keyring maps the key IDs of signed requests to their shared secrets, e.g.
+//
+//	{"billing": "7f0c...", "etl": "b41e..."}
+type keyring map[string]string
+
+func loadKeyring(keyringPath string) (keyring, error) {
+	keyringJSON, err := ioutil.ReadFile(keyringPath)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load signing keyring: %v", err)
+	}
+
+	var keys keyring
+	err = json.Unmarshal(keyringJSON, &keys)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load signing keyring '%s': %v", keyringPath, err)
+	}
+	for keyID, secret := range keys {
+		if secret == "" {
+			return nil, fmt.Errorf("Cannot load signing keyring '%s': key '%s' has an empty secret", keyringPath, keyID)
+		}
+	}
+
+	return keys, nil
+}
+
+// The longest nonce of a signed request, so the seen nonces can't use unbounded memory
+const maxNonceLength = 128
+
+// signatureVerifier verifies HMAC-SHA256 signed requests (see package client),
+// rejecting requests signed more than window from now and replays of a nonce
+type signatureVerifier struct {
+	keys   keyring
+	window time.Duration
+
+	mutex     sync.Mutex
+	seen      map[string]time.Time // "<key ID>\n<nonce>" within the window, by when they can be forgotten
+	lastPrune time.Time
+}
+
+func newSignatureVerifier(keyringPath string, window time.Duration) (*signatureVerifier, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("Signature window must be positive")
+	}
+
+	keys, err := loadKeyring(keyringPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &signatureVerifier{
+		keys:   keys,
+		window: window,
+		seen:   map[string]time.Time{},
+	}, nil
+}
+
+// isSigned reports whether r claims to be signed
+func isSigned(r *http.Request) bool {
+	return r.Header.Get(client.SignatureHeader) != ""
+}
+
+// verify verifies the signature of r, whose body is body, at now and returns its key ID
+func (verifier *signatureVerifier) verify(r *http.Request, body []byte, now time.Time) (string, error) {
+	keyID := r.Header.Get(client.KeyIDHeader)
+	timestamp := r.Header.Get(client.TimestampHeader)
+	nonce := r.Header.Get(client.NonceHeader)
+	signature := r.Header.Get(client.SignatureHeader)
+	if keyID == "" || timestamp == "" || nonce == "" || signature == "" {
+		return "", fmt.Errorf("Signed request must have the %s, %s, %s and %s headers", client.KeyIDHeader, client.TimestampHeader, client.NonceHeader, client.SignatureHeader)
+	}
+	if len(nonce) > maxNonceLength {
+		return "", fmt.Errorf("Signature nonce is longer than %d characters", maxNonceLength)
+	}
+
+	secret, ok := verifier.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("Unknown signing key '%s'", keyID)
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("Invalid signature timestamp '%s', must be Unix seconds", timestamp)
+	}
+	signedAt := time.Unix(unix, 0)
+	if signedAt.Before(now.Add(-verifier.window)) || signedAt.After(now.Add(verifier.window)) {
+		return "", fmt.Errorf("Signature timestamp %s is outside the window of %v", signedAt.UTC().Format(time.RFC3339), verifier.window)
+	}
+
+	expected := client.Signature([]byte(secret), client.StringToSign(r.Method, r.URL.RequestURI(), timestamp, nonce, client.BodyHash(body)))
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", fmt.Errorf("Invalid signature of key '%s'", keyID)
+	}
+
+	verifier.mutex.Lock()
+	defer verifier.mutex.Unlock()
+
+	verifier.prune(now)
+	seenKey := keyID + "\n" + nonce
+	if _, ok := verifier.seen[seenKey]; ok {
+		return "", fmt.Errorf("Replayed nonce of key '%s'", keyID)
+	}
+	// The request is rejected by its timestamp after this
+	verifier.seen[seenKey] = signedAt.Add(verifier.window)
+
+	return keyID, nil
+}
+
+// prune forgets the nonces that are outside the window, at most once a window
+func (verifier *signatureVerifier) prune(now time.Time) {
+	if now.Sub(verifier.lastPrune) < verifier.window {
+		return
+	}
+	verifier.lastPrune = now
+
+	for seenKey, expires := range verifier.seen {
+		if now.After(expires) {
+			delete(verifier.seen, seenKey)
+		}
+	}
+}
+
+// authenticateSignature authenticates the signed request r and returns its key ID.
+// It reads r's body to hash it, and replaces it with an in-memory copy.
+// If the request isn't authenticated it responds and returns false.
+func (server *queryServer) authenticateSignature(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body []byte
+	if r.Body != nil {
+		reader := r.Body
+		maxBodyBytes := server.options.limits.maxBodyBytes
+		if maxBodyBytes > 0 {
+			reader = http.MaxBytesReader(w, reader, maxBodyBytes)
+		}
+
+		var err error
+		body, err = ioutil.ReadAll(reader)
+		if isBodyTooLarge(err) {
+			http.Error(w, fmt.Sprintf("\n\nRequest body is larger than %d bytes\n\n%s", maxBodyBytes, server.helpMessage), http.StatusRequestEntityTooLarge)
+			return "", false
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("\n\nError reading request body: %v\n\n%s", err, server.helpMessage), http.StatusInternalServerError)
+			return "", false
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	keyID, err := server.signatures.verify(r, body, time.Now())
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `HMAC-SHA256 realm="SQLiteQueryServer"`)
+		http.Error(w, fmt.Sprintf("\n\n%v\n\n%s", err, server.helpMessage), http.StatusUnauthorized)
+		return "", false
+	}
+
+	return keyID, true
+}
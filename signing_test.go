@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/assafmo/SQLiteQueryServer/client"
+	json "github.com/json-iterator/go"
+)
+
+func TestSignedRequests(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "signing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyringPath := filepath.Join(tmpDir, "keyring.json")
+	err = ioutil.WriteFile(keyringPath, []byte(`{"billing": "s3cr3t", "etl": "0th3r"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withSigning(keyringPath, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := func(body string, signer client.Signer) *http.Request {
+		req := httptest.NewRequest("POST", "http://example.org/query", strings.NewReader(body))
+		err := signer.Sign(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+	billing := client.Signer{KeyID: "billing", Secret: []byte("s3cr3t")}
+
+	replayed := signed("github.com", billing)
+	replayedBody := "github.com"
+	tampered := signed("github.com", billing)
+	tampered.Body = ioutil.NopCloser(strings.NewReader("gitlab.com"))
+	tamperedPath := signed("github.com", billing)
+	tamperedPath.URL.Path = "/stats"
+	missingKeyID := signed("github.com", billing)
+	missingKeyID.Header.Del(client.KeyIDHeader)
+	missingNonce := signed("github.com", billing)
+	missingNonce.Header.Del(client.NonceHeader)
+	// Two identical requests signed in the same second differ by their nonce
+	signedAt := time.Now()
+	sameSecond := client.Signer{KeyID: "billing", Secret: []byte("s3cr3t"), Now: func() time.Time { return signedAt }}
+	identical := signed("github.com", sameSecond)
+	identicalAgain := signed("github.com", sameSecond)
+	unsigned := httptest.NewRequest("POST", "http://example.org/query", strings.NewReader("github.com"))
+
+	for _, test := range []struct {
+		name       string
+		req        *http.Request
+		statusCode int
+	}{
+		{"signed", replayed, http.StatusOK},
+		{"replayed", func() *http.Request {
+			req := httptest.NewRequest("POST", "http://example.org/query", strings.NewReader(replayedBody))
+			req.Header = replayed.Header.Clone()
+			return req
+		}(), http.StatusUnauthorized},
+		{"identical", identical, http.StatusOK},
+		{"identical again", identicalAgain, http.StatusOK},
+		{"other key", signed("github.com", client.Signer{KeyID: "etl", Secret: []byte("0th3r")}), http.StatusOK},
+		{"wrong secret", signed("github.com", client.Signer{KeyID: "billing", Secret: []byte("nope")}), http.StatusUnauthorized},
+		{"unknown key", signed("github.com", client.Signer{KeyID: "nope", Secret: []byte("s3cr3t")}), http.StatusUnauthorized},
+		{"tampered body", tampered, http.StatusUnauthorized},
+		{"tampered path", tamperedPath, http.StatusUnauthorized},
+		{"missing key ID", missingKeyID, http.StatusUnauthorized},
+		{"missing nonce", missingNonce, http.StatusUnauthorized},
+		{"expired", signed("github.com", client.Signer{KeyID: "billing", Secret: []byte("s3cr3t"), Now: func() time.Time { return time.Now().Add(-2 * time.Minute) }}), http.StatusUnauthorized},
+		{"from the future", signed("github.com", client.Signer{KeyID: "billing", Secret: []byte("s3cr3t"), Now: func() time.Time { return time.Now().Add(2 * time.Minute) }}), http.StatusUnauthorized},
+		{"unsigned", unsigned, http.StatusUnauthorized},
+	} {
+		w := httptest.NewRecorder()
+		queryHandler(w, test.req)
+
+		resp := w.Result()
+		if resp.StatusCode != test.statusCode {
+			t.Fatalf(`%s: resp.StatusCode (%d) != %d`, test.name, resp.StatusCode, test.statusCode)
+		}
+		if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Fatalf(`%s: 401 response should have a WWW-Authenticate header`, test.name)
+		}
+		if resp.StatusCode != http.StatusOK {
+			continue
+		}
+
+		// The body was read to verify it, the query still gets all of it
+		var fullResponse []queryResult
+		err = json.NewDecoder(resp.Body).Decode(&fullResponse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fullResponse) != 1 || len(fullResponse[0].Out) != 2 {
+			t.Fatalf(`%s: fullResponse (%v) should have 2 rows`, test.name, fullResponse)
+		}
+	}
+}
+
+func TestSignedRequestsWithAPIKeys(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "signing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyringPath := filepath.Join(tmpDir, "keyring.json")
+	err = ioutil.WriteFile(keyringPath, []byte(`{"billing": "s3cr3t"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keysPath := filepath.Join(tmpDir, "keys.db")
+	store, err := openKeyStore(keysPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dashboardKey, _, err := store.add("dashboard", []string{"/query"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.close()
+
+	queryHandler, err := initQueryHandler(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0,
+		withSigning(keyringPath, time.Minute), withKeyStore(keysPath), withLimits(limits{maxBodyBytes: 20}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	billing := client.Signer{KeyID: "billing", Secret: []byte("s3cr3t")}
+	signed := httptest.NewRequest("POST", "http://example.org/query", strings.NewReader("github.com"))
+	err = billing.Sign(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tooLarge := httptest.NewRequest("POST", "http://example.org/query", strings.NewReader(strings.Repeat("github.com\n", 3)))
+	err = billing.Sign(tooLarge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withAPIKey := httptest.NewRequest("POST", "http://example.org/query", strings.NewReader("github.com"))
+	withAPIKey.Header.Set("X-API-Key", dashboardKey)
+	anonymous := httptest.NewRequest("POST", "http://example.org/query", strings.NewReader("github.com"))
+
+	for _, test := range []struct {
+		name       string
+		req        *http.Request
+		statusCode int
+	}{
+		{"signed", signed, http.StatusOK},
+		{"signed body too large", tooLarge, http.StatusRequestEntityTooLarge},
+		{"API key", withAPIKey, http.StatusOK},
+		{"anonymous", anonymous, http.StatusUnauthorized},
+	} {
+		w := httptest.NewRecorder()
+		queryHandler(w, test.req)
+
+		resp := w.Result()
+		if resp.StatusCode != test.statusCode {
+			t.Fatalf(`%s: resp.StatusCode (%d) != %d`, test.name, resp.StatusCode, test.statusCode)
+		}
+		if test.name == "anonymous" {
+			body, _ := ioutil.ReadAll(resp.Body)
+			if !strings.Contains(string(body), "Request signature or API key is required") {
+				t.Fatalf(`%s: body (%s) should name both credentials`, test.name, body)
+			}
+		}
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "signing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, keyringJSON := range []string{`{"billing": ""}`, `["billing"]`, `{`} {
+		keyringPath := filepath.Join(tmpDir, "keyring.json")
+		err = ioutil.WriteFile(keyringPath, []byte(keyringJSON), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = newSignatureVerifier(keyringPath, time.Minute)
+		if err == nil {
+			t.Fatalf(`newSignatureVerifier() should fail with keyring %s`, keyringJSON)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the certificate files are checked for changes
+const certWatchInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(tlsVersion string) (uint16, error) {
+	version, ok := tlsVersions[tlsVersion]
+	if !ok {
+		return 0, fmt.Errorf("Unknown TLS version '%s', must be one of: 1.0, 1.1, 1.2, 1.3", tlsVersion)
+	}
+	return version, nil
+}
+
+// certReloader serves a TLS certificate from files,
+// and reloads it when they change, without dropping connections
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	certInfo os.FileInfo
+	keyInfo  os.FileInfo
+}
+
+func newCertReloader(certPath string, keyPath string) (*certReloader, error) {
+	reloader := &certReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+	}
+
+	err := reloader.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+// reload loads the certificate files.
+// If they are invalid the previous certificate keeps being served.
+func (reloader *certReloader) reload() error {
+	// Stat before loading, so a change while loading is loaded again
+	certInfo, err := os.Stat(reloader.certPath)
+	if err != nil {
+		return fmt.Errorf("Cannot load TLS certificate: %v", err)
+	}
+	keyInfo, err := os.Stat(reloader.keyPath)
+	if err != nil {
+		return fmt.Errorf("Cannot load TLS key: %v", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(reloader.certPath, reloader.keyPath)
+	if err != nil {
+		return fmt.Errorf("Cannot load TLS certificate '%s' and key '%s': %v", reloader.certPath, reloader.keyPath, err)
+	}
+
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+
+	reloader.cert = &cert
+	reloader.certInfo = certInfo
+	reloader.keyInfo = keyInfo
+
+	return nil
+}
+
+// changed reports whether the certificate files changed since they were loaded
+func (reloader *certReloader) changed() bool {
+	certInfo, err := os.Stat(reloader.certPath)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(reloader.keyPath)
+	if err != nil {
+		return false
+	}
+
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+
+	return !sameFileInfo(certInfo, reloader.certInfo) || !sameFileInfo(keyInfo, reloader.keyInfo)
+}
+
+// getCertificate is the tls.Config's GetCertificate
+func (reloader *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+
+	return reloader.cert, nil
+}
+
+// reloadLoop reloads the certificate files when they change (checked every watchInterval)
+// and on every reloadSignal (if not nil)
+func (reloader *certReloader) reloadLoop(watchInterval time.Duration, reloadSignal <-chan os.Signal) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !reloader.changed() {
+				continue
+			}
+		case <-reloadSignal:
+		}
+
+		err := reloader.reload()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		log.Printf("Reloaded TLS certificate '%s'\n", reloader.certPath)
+	}
+}
+
+// tlsConfig returns the TLS settings of the server, serving the certificate of reloader.
+// If clientCAs isn't nil, clients must present a certificate issued by one of them.
+func (reloader *certReloader) tlsConfig(minVersion uint16, clientCAs *x509.CertPool) *tls.Config {
+	config := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: reloader.getCertificate,
+	}
+	if clientCAs != nil {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = clientCAs
+	}
+	return config
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key,
+// and returns the certificate
+func writeTestCert(t *testing.T, certPath string, keyPath string, commonName string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestTLS(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	certPath := filepath.Join(tmpDir, "cert.pem")
+	keyPath := filepath.Join(tmpDir, "key.pem")
+	cert := writeTestCert(t, certPath, keyPath, "first")
+
+	reloader, err := newCertReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := newQueryServer(testDbPath, "SELECT * FROM ip_dns WHERE dns = ?", 0, withOpenMode(openModeReadOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(server, listener, nil, reloader.tlsConfig(tls.VersionTLS12, nil), time.Second, stop)
+	}()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: rootCAs}}}
+
+	resp, err := client.Post("https://"+listener.Addr().String()+"/query", "text/csv", strings.NewReader("github.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(`resp.StatusCode (%d) != http.StatusOK (%d)`, resp.StatusCode, http.StatusOK)
+	}
+	if resp.TLS == nil || resp.TLS.Version < tls.VersionTLS12 {
+		t.Fatal(`The response should be over TLS 1.2 or later`)
+	}
+
+	// Plain HTTP is rejected
+	resp, err = http.Post("http://"+listener.Addr().String()+"/query", "text/csv", strings.NewReader("github.com"))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Fatal(`Plain HTTP shouldn't be served`)
+		}
+	}
+
+	stop <- syscall.SIGTERM
+	err = <-served
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	certPath := filepath.Join(tmpDir, "cert.pem")
+	keyPath := filepath.Join(tmpDir, "key.pem")
+	writeTestCert(t, certPath, keyPath, "first")
+
+	reloader, err := newCertReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commonName := func() string {
+		cert, err := reloader.getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	if commonName() != "first" {
+		t.Fatalf(`commonName() (%s) != "first"`, commonName())
+	}
+
+	reloadSignal := make(chan os.Signal, 1)
+	go reloader.reloadLoop(10*time.Millisecond, reloadSignal)
+
+	// An invalid certificate isn't loaded
+	err = ioutil.WriteFile(keyPath, []byte("banana"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadSignal <- syscall.SIGHUP
+	time.Sleep(50 * time.Millisecond)
+	if commonName() != "first" {
+		t.Fatalf(`commonName() (%s) != "first"`, commonName())
+	}
+
+	writeTestCert(t, certPath, keyPath, "second")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for commonName() != "second" {
+		if time.Now().After(deadline) {
+			t.Fatal(`The changed certificate should have been reloaded`)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCertReloadOnSIGHUP(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+
+	tmpDir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	certPath := filepath.Join(tmpDir, "cert.pem")
+	keyPath := filepath.Join(tmpDir, "key.pem")
+	writeTestCert(t, certPath, keyPath, "first")
+
+	reloader, err := newCertReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Like cmd(), the certificate and the database are notified on their own channels
+	certReloadSignal := make(chan os.Signal, 1)
+	signal.Notify(certReloadSignal, syscall.SIGHUP)
+	defer signal.Stop(certReloadSignal)
+	dbReloadSignal := make(chan os.Signal, 1)
+	signal.Notify(dbReloadSignal, syscall.SIGHUP)
+	defer signal.Stop(dbReloadSignal)
+
+	// Changes aren't watched in time, only SIGHUP reloads the certificate
+	go reloader.reloadLoop(time.Hour, certReloadSignal)
+
+	writeTestCert(t, certPath, keyPath, "second")
+	err = syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-dbReloadSignal:
+	case <-time.After(5 * time.Second):
+		t.Fatal(`SIGHUP should have been delivered to the database's channel as well`)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cert, err := reloader.getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaf.Subject.CommonName == "second" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(`The certificate should have been reloaded on SIGHUP`)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	version, err := parseTLSVersion("1.3")
+	if err != nil || version != tls.VersionTLS13 {
+		t.Fatalf(`parseTLSVersion("1.3") (%d, %v) != tls.VersionTLS13`, version, err)
+	}
+
+	_, err = parseTLSVersion("banana")
+	if err == nil {
+		t.Fatal(`Should fail with an unknown TLS version`)
+	}
+}
+
+func TestMainTLSCertWithoutKey(t *testing.T) {
+	err := cmd([]string{
+		"--db",
+		testDbPath,
+		"--query",
+		"SELECT * FROM ip_dns WHERE dns = ?",
+		"--tls-cert",
+		"cert.pem",
+	})
+	if err == nil {
+		t.Fatal(`Should throw an error`)
+	}
+	if !strings.Contains(err.Error(), "Must provide both --tls-cert and --tls-key") {
+		t.Fatalf(`Should throw a "Must provide both --tls-cert and --tls-key" error: %v`, err)
+	}
+}